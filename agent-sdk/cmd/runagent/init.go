@@ -13,7 +13,8 @@ var (
 	dag *dagger.Client
 )
 
-func init() {
+// Open the engine session
+func connect() {
 	ctx = context.Background()
 	if c, err := dagger.Connect(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "open dagger session: %s", err.Error())
@@ -0,0 +1,442 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The JSON schema of agent.yaml
+//
+//go:embed agent.schema.json
+var agentSchemaJSON []byte
+
+// The subset of JSON schema used by agent.schema.json
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Description          string                 `json:"description"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinLength            int                    `json:"minLength"`
+	Pattern              string                 `json:"pattern"`
+}
+
+// The types of inputs and outputs, as normalized by normalizeTypename
+var bindingTypes = map[string]bool{
+	"String":    true,
+	"Int":       true,
+	"Integer":   true,
+	"Bool":      true,
+	"Directory": true,
+	"File":      true,
+	"Container": true,
+	"Secret":    true,
+	"Service":   true,
+	"Void":      true,
+}
+
+// An error in agent.yaml
+type LintError struct {
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (e LintError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s: %s", e.Line, e.Column, e.Path, e.Message)
+}
+
+// All the errors in agent.yaml, ordered by position
+type LintErrors []LintError
+
+func (errs LintErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Check an agent configuration against the schema, and for mistakes the schema can't express,
+// like duplicate names. Return nil, or LintErrors.
+func LintAgent(data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(agentSchemaJSON, &schema); err != nil {
+		return fmt.Errorf("load agent schema: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return LintErrors{{Line: 1, Column: 1, Message: "empty configuration"}}
+	}
+	root := doc.Content[0]
+	l := &linter{root: &schema}
+	l.validate(root, &schema, "")
+	l.checkTemplates(root, "")
+	l.checkNames(root)
+	if len(l.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(l.errs, func(i, j int) bool {
+		if l.errs[i].Line != l.errs[j].Line {
+			return l.errs[i].Line < l.errs[j].Line
+		}
+		return l.errs[i].Column < l.errs[j].Column
+	})
+	return l.errs
+}
+
+type linter struct {
+	// The root schema, to resolve references
+	root *jsonSchema
+	errs LintErrors
+}
+
+func (l *linter) errorf(node *yaml.Node, path, format string, args ...any) {
+	l.errs = append(l.errs, LintError{
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate a node against a schema
+func (l *linter) validate(node *yaml.Node, schema *jsonSchema, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if schema.Ref != "" {
+		name, ok := strings.CutPrefix(schema.Ref, "#/$defs/")
+		def := l.root.Defs[name]
+		if !ok || def == nil {
+			l.errorf(node, path, "unresolved schema reference: %q", schema.Ref)
+			return
+		}
+		schema = def
+	}
+	switch schema.Type {
+	case "object":
+		if node.Kind != yaml.MappingNode {
+			l.errorf(node, path, "expected an object, got %s", describeNode(node))
+			return
+		}
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if seen[key.Value] {
+				l.errorf(key, path, "duplicate key %q", key.Value)
+				continue
+			}
+			seen[key.Value] = true
+			prop, ok := schema.Properties[key.Value]
+			if !ok {
+				if schema.AdditionalProperties == nil || *schema.AdditionalProperties {
+					continue
+				}
+				l.errorf(key, path, "unknown key %q%s", key.Value, suggestKey(key.Value, schema.Properties))
+				continue
+			}
+			l.validate(value, prop, joinPath(path, key.Value))
+		}
+		for _, name := range schema.Required {
+			if !seen[name] {
+				l.errorf(node, path, "missing required key %q", name)
+			}
+		}
+	case "array":
+		if node.Kind != yaml.SequenceNode {
+			l.errorf(node, path, "expected a list, got %s", describeNode(node))
+			return
+		}
+		if schema.Items != nil {
+			for i, item := range node.Content {
+				l.validate(item, schema.Items, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case "string":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!str" {
+			l.errorf(node, path, "expected a string, got %s", describeNode(node))
+			return
+		}
+		if utf8.RuneCountInString(node.Value) < schema.MinLength {
+			l.errorf(node, path, "must not be empty")
+		}
+		if schema.Pattern != "" {
+			if matched, err := regexp.MatchString(schema.Pattern, node.Value); err != nil || !matched {
+				if schema.Description != "" {
+					l.errorf(node, path, "invalid value %q: %s", node.Value, schema.Description)
+				} else {
+					l.errorf(node, path, "invalid value %q", node.Value)
+				}
+			}
+		}
+	case "boolean":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			l.errorf(node, path, "expected true or false, got %s", describeNode(node))
+		}
+	}
+}
+
+// Check names and types: duplicate action, input and output names, unknown types,
+// and references between steps
+func (l *linter) checkNames(root *yaml.Node) {
+	actions := mappingValue(root, "actions")
+	if actions == nil || actions.Kind != yaml.SequenceNode {
+		return
+	}
+	actionNames := map[string]bool{}
+	for i, action := range actions.Content {
+		path := fmt.Sprintf("actions[%d]", i)
+		if name := mappingValue(action, "name"); name != nil && name.Value != "" {
+			if actionNames[name.Value] {
+				l.errorf(name, path, "duplicate action name %q", name.Value)
+			}
+			actionNames[name.Value] = true
+		}
+		l.checkTemplates(action, path)
+		inputs := l.checkBindings(action, path, "inputs")
+		outputs := l.checkBindings(action, path, "outputs")
+		l.checkSteps(action, path, inputs, outputs)
+	}
+}
+
+// Check that the prompt templates of the agent or an action parse
+func (l *linter) checkTemplates(parent *yaml.Node, path string) {
+	for _, key := range []string{"system_prompt", "prompt_template"} {
+		text := mappingValue(parent, key)
+		if text == nil || text.Tag != "!!str" {
+			continue
+		}
+		// Files are only read when the template is executed
+		if _, err := parsePromptTemplate(key, text.Value, "."); err != nil {
+			l.errorf(text, joinPath(path, key), "%s", err.Error())
+		}
+	}
+}
+
+// Check the inputs or outputs of an action or step.
+// Return their normalized types by name: empty for unknown types.
+// List outputs can't be bound, so they are left out.
+func (l *linter) checkBindings(parent *yaml.Node, path, key string) map[string]string {
+	types := map[string]string{}
+	bindings := mappingValue(parent, key)
+	if bindings == nil || bindings.Kind != yaml.SequenceNode {
+		return types
+	}
+	seen := map[string]bool{}
+	for j, binding := range bindings.Content {
+		bindingPath := fmt.Sprintf("%s.%s[%d]", path, key, j)
+		name := mappingValue(binding, "name")
+		if name != nil && name.Value != "" {
+			if seen[name.Value] {
+				l.errorf(name, bindingPath, "duplicate %s name %q", strings.TrimSuffix(key, "s"), name.Value)
+			}
+			seen[name.Value] = true
+			types[name.Value] = ""
+		}
+		typ := mappingValue(binding, "type")
+		if typ == nil || typ.Tag != "!!str" || typ.Value == "" {
+			continue
+		}
+		typename := normalizeTypename(typ.Value)
+		elem, isList := listElement(typename)
+		switch {
+		case isList && key == "outputs":
+			// Rejected by the schema
+			if name != nil {
+				delete(types, name.Value)
+			}
+		case isList && (!bindingTypes[elem] || elem == "Void"):
+			l.errorf(typ, bindingPath, "unknown type %q", typ.Value)
+		case !isList && !bindingTypes[typename]:
+			l.errorf(typ, bindingPath, "unknown type %q", typ.Value)
+		case typename == "Void" && key == "inputs":
+			l.errorf(typ, bindingPath, "inputs can't be void")
+		default:
+			if name != nil && name.Value != "" {
+				types[name.Value] = typename
+			}
+		}
+	}
+	return types
+}
+
+// Check the steps of an action: their names, the tools they use,
+// and that they produce the outputs of the action
+func (l *linter) checkSteps(action *yaml.Node, path string, inputs, outputs map[string]string) {
+	steps := mappingValue(action, "steps")
+	if steps == nil || steps.Kind != yaml.SequenceNode || len(steps.Content) == 0 {
+		return
+	}
+	// The types of the values available to the next step, by name
+	available := map[string]string{}
+	for name, typename := range inputs {
+		available[name] = typename
+	}
+	produced := map[string]string{}
+	stepNames := map[string]bool{}
+	for i, step := range steps.Content {
+		stepPath := fmt.Sprintf("%s.steps[%d]", path, i)
+		if name := mappingValue(step, "name"); name != nil && name.Value != "" {
+			if stepNames[name.Value] {
+				l.errorf(name, stepPath, "duplicate step name %q", name.Value)
+			}
+			stepNames[name.Value] = true
+		}
+		if tools := mappingValue(step, "tools"); tools != nil && tools.Kind == yaml.SequenceNode {
+			for _, tool := range tools.Content {
+				if _, ok := available[tool.Value]; !ok && tool.Tag == "!!str" {
+					l.errorf(tool, stepPath, "unknown tool %q: not an action input or a previous step output", tool.Value)
+				}
+			}
+		}
+		for name, typename := range l.checkBindings(step, stepPath, "outputs") {
+			available[name] = typename
+			produced[name] = typename
+		}
+	}
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		typename, stepType := outputs[name], produced[name]
+		if typename == "Integer" {
+			typename = "Int"
+		}
+		if stepType == "Integer" {
+			stepType = "Int"
+		}
+		_, ok := produced[name]
+		switch {
+		case !ok:
+			l.errorf(steps, path, "output %q is not produced by any step", name)
+		case typename != "" && stepType != "" && typename != stepType:
+			l.errorf(steps, path, "output %q is a %s, but its step produces a %s", name, typename, stepType)
+		}
+	}
+}
+
+// Return the value of a key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			value := node.Content[i+1]
+			if value.Kind == yaml.AliasNode {
+				value = value.Alias
+			}
+			return value
+		}
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "an object"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	switch node.Tag {
+	case "!!null":
+		return "nothing"
+	case "!!str":
+		return fmt.Sprintf("string %q", node.Value)
+	}
+	return node.Value
+}
+
+// Suggest a known key for a misspelled one
+func suggestKey(key string, properties map[string]*jsonSchema) string {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.EqualFold(name, key) || levenshtein(name, key) <= 2 {
+			return fmt.Sprintf(" (did you mean %q?)", name)
+		}
+	}
+	return ""
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// Check agent.yaml files, without an engine session.
+// Print their errors, and return the number of files with errors.
+func lint(paths []string) int {
+	if len(paths) == 0 {
+		paths = []string{"agent.yaml"}
+	}
+	failed := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = LintAgent(data)
+		}
+		if err == nil {
+			continue
+		}
+		failed++
+		if errs, ok := err.(LintErrors); ok {
+			for _, e := range errs {
+				fmt.Fprintf(os.Stderr, "%s:%s\n", path, e.Error())
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+		}
+	}
+	return failed
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintAgent(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		yaml string
+		// The errors, as printed by runagent lint
+		want []string
+	}{
+		{
+			name: "valid",
+			yaml: `
+model: gpt-4o
+actions:
+  - name: review
+    description: Review the code
+    inputs:
+      - name: source
+        type: directory
+      - name: paths
+        type: "[string]"
+        optional: true
+    steps:
+      - name: read
+        prompt: Read the code
+        outputs:
+          - name: notes
+            type: string
+      - name: write
+        prompt: Write the review
+        tools: [notes]
+        outputs:
+          - name: review
+            type: file
+    outputs:
+      - name: review
+        type: File
+`,
+		},
+		{
+			name: "unknown keys",
+			yaml: `
+model: gpt-4o
+modle: gpt-4o
+actions:
+  - name: hello
+    descripton: Say hello
+    outputs:
+      - name: greeting
+        type: string
+        optinal: true
+`,
+			want: []string{
+				`2:1: unknown key "modle" (did you mean "model"?)`,
+				`5:5: actions[0]: unknown key "descripton" (did you mean "description"?)`,
+				`9:9: actions[0].outputs[0]: unknown key "optinal" (did you mean "optional"?)`,
+			},
+		},
+		{
+			name: "misspelled types",
+			yaml: `
+actions:
+  - name: hello
+    inputs:
+      - name: who
+        type: strng
+      - name: where
+        type: "[directroy]"
+      - name: what
+        type: void
+    outputs:
+      - name: greeting
+        type: dir
+`,
+			want: []string{
+				`5:15: actions[0].inputs[0]: unknown type "strng"`,
+				`7:15: actions[0].inputs[1]: unknown type "[directroy]"`,
+				`9:15: actions[0].inputs[2]: inputs can't be void`,
+				`12:15: actions[0].outputs[0]: unknown type "dir"`,
+			},
+		},
+		{
+			name: "duplicates",
+			yaml: `
+actions:
+  - name: hello
+    inputs:
+      - name: who
+        type: string
+      - name: who
+        type: string
+    steps:
+      - name: greet
+        prompt: Greet
+        outputs:
+          - name: greeting
+            type: string
+      - name: greet
+        prompt: Greet again
+    outputs:
+      - name: greeting
+        type: string
+      - name: greeting
+        type: string
+  - name: hello
+`,
+			want: []string{
+				`6:15: actions[0].inputs[1]: duplicate input name "who"`,
+				`14:15: actions[0].steps[1]: duplicate step name "greet"`,
+				`19:15: actions[0].outputs[1]: duplicate output name "greeting"`,
+				`21:11: actions[1]: duplicate action name "hello"`,
+			},
+		},
+		{
+			name: "missing names",
+			yaml: `
+actions:
+  - description: Say hello
+    inputs:
+      - type: string
+    steps:
+      - prompt: Greet
+`,
+			want: []string{
+				`2:5: actions[0]: missing required key "name"`,
+				`4:9: actions[0].inputs[0]: missing required key "name"`,
+				`6:9: actions[0].steps[0]: missing required key "name"`,
+			},
+		},
+		{
+			name: "outputs not produced",
+			yaml: `
+actions:
+  - name: hello
+    inputs:
+      - name: who
+        type: string
+    steps:
+      - name: greet
+        prompt: Greet
+        tools: [who, greeting]
+        outputs:
+          - name: greeting
+            type: file
+    outputs:
+      - name: greeting
+        type: string
+      - name: farewell
+        type: string
+`,
+			want: []string{
+				`7:7: actions[0]: output "farewell" is not produced by any step`,
+				`7:7: actions[0]: output "greeting" is a String, but its step produces a File`,
+				`9:22: actions[0].steps[0]: unknown tool "greeting": not an action input or a previous step output`,
+			},
+		},
+		{
+			name: "list outputs",
+			yaml: `
+actions:
+  - name: hello
+    inputs:
+      - name: names
+        type: "[string]"
+    outputs:
+      - name: greetings
+        type: "[string]"
+`,
+			want: []string{
+				`8:15: actions[0].outputs[0].type: invalid value "[string]": string, int, bool, directory, file, container, secret, service or void. Case insensitive. Outputs can't be lists`,
+			},
+		},
+		{
+			name: "list step outputs",
+			yaml: `
+actions:
+  - name: hello
+    steps:
+      - name: list
+        prompt: List names
+        outputs:
+          - name: names
+            type: "[string]"
+      - name: greet
+        prompt: Greet them
+        tools: [names]
+`,
+			want: []string{
+				`8:19: actions[0].steps[0].outputs[0].type: invalid value "[string]": string, int, bool, directory, file, container, secret, service or void. Case insensitive. Outputs can't be lists`,
+				`11:17: actions[0].steps[1]: unknown tool "names": not an action input or a previous step output`,
+			},
+		},
+		{
+			name: "wrong kinds",
+			yaml: `
+model: 4
+actions:
+  name: hello
+`,
+			want: []string{
+				`1:8: model: expected a string, got 4`,
+				`3:3: actions: expected a list, got an object`,
+			},
+		},
+		{
+			name: "templates",
+			yaml: `
+prompt_template: "{{.Task"
+actions:
+  - name: hello
+    system_prompt: "{{if}}"
+`,
+			want: []string{
+				`1:18: prompt_template: template: prompt_template:1: unclosed action`,
+				`4:20: actions[0].system_prompt: template: system_prompt:1: missing value for if`,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := LintAgent([]byte(strings.TrimPrefix(test.yaml, "\n")))
+			var got []string
+			if err != nil {
+				var errs LintErrors
+				if !errors.As(err, &errs) {
+					t.Fatalf("expected lint errors, got %v", err)
+				}
+				for _, e := range errs {
+					got = append(got, e.Error())
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLintExamples(t *testing.T) {
+	paths, err := filepath.Glob("../../examples/*/agent.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no examples")
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := LintAgent(data); err != nil {
+			t.Errorf("%s:\n%v", path, err)
+		}
+	}
+}
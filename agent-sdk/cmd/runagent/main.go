@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"dagger.io/dagger"
@@ -12,6 +14,13 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		if lint(os.Args[2:]) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	connect()
 	agent, err := CurrentAgent(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to load agent: %s", err.Error())
@@ -24,9 +33,14 @@ func main() {
 }
 
 type Agent struct {
-	Name    string    `yaml:"-"`
-	Model   string    `yaml:"model"`
-	Actions []*Action `yaml:"actions,omitempty"`
+	Name  string `yaml:"-"`
+	Model string `yaml:"model"`
+	// Templates of the system prompt and the prompt of actions without their own
+	SystemPrompt   string    `yaml:"system_prompt,omitempty"`
+	PromptTemplate string    `yaml:"prompt_template,omitempty"`
+	Actions        []*Action `yaml:"actions,omitempty"`
+	// The module directory, where prompt templates include files from
+	dir string
 }
 
 func CurrentAgent(ctx context.Context) (*Agent, error) {
@@ -38,11 +52,15 @@ func CurrentAgent(ctx context.Context) (*Agent, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := LintAgent(data); err != nil {
+		return nil, fmt.Errorf("invalid %s:\n%w", configPath, err)
+	}
 	var cfg Agent
 	err = yaml.Unmarshal(data, &cfg)
 	if err != nil {
 		return nil, err
 	}
+	cfg.dir = filepath.Dir(configPath)
 	for _, action := range cfg.Actions {
 		fmt.Printf("loaded action %q\n", action.Name)
 		action.agent = &cfg
@@ -50,16 +68,18 @@ func CurrentAgent(ctx context.Context) (*Agent, error) {
 			action.Model = cfg.Model
 		}
 		for _, input := range action.Inputs {
-			if input.Typename == "" {
-				continue
-			}
-			input.Typename = strings.ToUpper(input.Typename[0:1]) + strings.ToLower(input.Typename[1:])
+			input.Typename = normalizeTypename(input.Typename)
 		}
 		for _, output := range action.Outputs {
-			if output.Typename == "" {
-				continue
+			output.Typename = normalizeTypename(output.Typename)
+		}
+		for _, step := range action.Steps {
+			if step.Model == "" {
+				step.Model = action.Model
+			}
+			for _, output := range step.Outputs {
+				output.Typename = normalizeTypename(output.Typename)
 			}
-			output.Typename = strings.ToUpper(output.Typename[0:1]) + strings.ToLower(output.Typename[1:])
 		}
 	}
 	moduleName, err := dag.CurrentModule().Name(ctx)
@@ -70,6 +90,25 @@ func CurrentAgent(ctx context.Context) (*Agent, error) {
 	return &cfg, nil
 }
 
+// Capitalize a type name, eg. "string" to "String", and "[directory]" to "[Directory]"
+func normalizeTypename(typename string) string {
+	if elem, ok := listElement(typename); ok {
+		return "[" + normalizeTypename(elem) + "]"
+	}
+	if typename == "" {
+		return ""
+	}
+	return strings.ToUpper(typename[0:1]) + strings.ToLower(typename[1:])
+}
+
+// Return the element type of a list type, eg. "String" for "[String]"
+func listElement(typename string) (string, bool) {
+	if len(typename) > 2 && strings.HasPrefix(typename, "[") && strings.HasSuffix(typename, "]") {
+		return typename[1 : len(typename)-1], true
+	}
+	return "", false
+}
+
 func (a *Agent) Dispatch(ctx context.Context, call *Call) (any, error) {
 	switch call.ParentName {
 	case "":
@@ -120,6 +159,10 @@ type Action struct {
 	Description string     `yaml:"description"`
 	Inputs      []*Binding `yaml:"inputs,omitempty"`
 	Outputs     []*Binding `yaml:"outputs,omitempty"`
+	Steps       []*Step    `yaml:"steps,omitempty"`
+	// Templates of the system prompt and the prompt, instead of the agent's
+	SystemPrompt   string `yaml:"system_prompt,omitempty"`
+	PromptTemplate string `yaml:"prompt_template,omitempty"`
 }
 
 func (action *Action) Dump() string {
@@ -131,15 +174,33 @@ func (action *Action) Dump() string {
 }
 
 func (action *Action) Dispatch(ctx context.Context, call *Call) (any, error) {
-	llm, err := action.LLM(ctx, call)
-	if err != nil {
-		return nil, err
+	// The outputs produced by each step, available to the next ones
+	var produced stepOutputs
+	for i, step := range action.pipeline() {
+		llm, err := action.LLM(ctx, call, step, i, produced)
+		if err != nil {
+			return nil, err
+		}
+		// Execute the agentic loop, and retrieve the modified env
+		llm, err = llm.Loop().Sync(ctx)
+		if err != nil {
+			if len(action.Steps) > 0 {
+				return nil, fmt.Errorf("step %q: %w", step.Name, err)
+			}
+			return nil, err
+		}
+		env := llm.Env()
+		for _, output := range step.Outputs {
+			produced.set(stepOutput{binding: output, env: env})
+		}
 	}
-	// Execute the agentic loop, and retrieve the modified env
-	env := llm.Loop().Env()
 	result := map[string]any{}
 	for _, output := range action.Outputs {
-		val, err := output.OutputValue(env)
+		step, ok := produced.get(output.Name)
+		if !ok {
+			return nil, fmt.Errorf("output %q: not produced by any step", output.Name)
+		}
+		val, err := output.OutputValue(step.env)
 		if err != nil {
 			return nil, err
 		}
@@ -148,34 +209,58 @@ func (action *Action) Dispatch(ctx context.Context, call *Call) (any, error) {
 	return result, nil
 }
 
-func (action *Action) LLM(ctx context.Context, call *Call) (*dagger.LLM, error) {
+// Prepare the LLM running a step of the action.
+// Its environment has the action inputs and the outputs of the previous steps, that the step uses.
+func (action *Action) LLM(ctx context.Context, call *Call, step *Step, index int, produced stepOutputs) (*dagger.LLM, error) {
 	// Initialize the LLM's environment
 	env := dag.Env(dagger.EnvOpts{Privileged: true})
 	var err error
 	// Bind environment inputs
 	for _, input := range action.Inputs {
+		if !step.uses(input.Name) {
+			continue
+		}
 		env, err = input.BindInput(env, call)
 		if err != nil {
 			return nil, err
 		}
 	}
+	// Bind the outputs of previous steps as inputs
+	for _, prev := range produced {
+		if !step.uses(prev.binding.Name) {
+			continue
+		}
+		env, err = prev.binding.BindFrom(env, prev.env)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// Bind environment outputs
-	for _, output := range action.Outputs {
+	for _, output := range step.Outputs {
 		env, err = output.BindOutput(env)
 		if err != nil {
 			return nil, err
 		}
 	}
+	data, err := action.promptData(call, step, index)
+	if err != nil {
+		return nil, err
+	}
+	prompt, err := action.renderPrompt("prompt_template", action.promptTemplate(), data)
+	if err != nil {
+		return nil, err
+	}
 	agent := dag.
-		LLM(dagger.LLMOpts{Model: action.Model}).
-		WithEnv(env).
-		WithPrompt(fmt.Sprintf(`You are %s, a helpful assistant. Your task is: <task>%s</task>
-To accomplish your task, you are given access to all the tools you need. Use them, don't tell the user to use them.
-When you are finished, use the 'return' tool to return the required outputs to the user.
-Take care to read the descriptions of your available tools, as well as the required arguments for the return tool.
-They are important to accomplish your task.
-Again, your task is: <task>%s</task>`, action.agent.Name, action.Description, action.Description))
-	return agent, nil
+		LLM(dagger.LLMOpts{Model: step.Model}).
+		WithEnv(env)
+	if text := action.systemPrompt(); text != "" {
+		system, err := action.renderPrompt("system_prompt", text, data)
+		if err != nil {
+			return nil, err
+		}
+		agent = agent.WithSystemPrompt(system)
+	}
+	return agent.WithPrompt(prompt), nil
 }
 
 func (action *Action) Function() (*dagger.Function, error) {
@@ -185,6 +270,9 @@ func (action *Action) Function() (*dagger.Function, error) {
 	// Each action output is a field in the return type
 	for _, output := range action.Outputs {
 		fmt.Printf("%q: examining output %q\n", action.Name, output.Name)
+		if _, isList := listElement(output.Typename); isList {
+			return nil, fmt.Errorf("%s: output %q: list outputs are not supported", action.Name, output.Name)
+		}
 		outputType, err := output.Type()
 		if err != nil {
 			return nil, fmt.Errorf("%s: parse type for output %q: %s", action.Name, output.Name, err.Error())
@@ -205,8 +293,8 @@ func (action *Action) Function() (*dagger.Function, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parse type for input %q: %s", input.Name, err.Error())
 		}
-		if input.Optional != nil {
-			inputType = inputType.WithOptional(*input.Optional)
+		if input.IsOptional() {
+			inputType = inputType.WithOptional(true)
 		}
 		fn = fn.WithArg(input.Name, inputType, dagger.FunctionWithArgOpts{
 			Description: input.Description,
@@ -223,33 +311,99 @@ type Binding struct {
 	Instructions *string `yaml:"instructions,omitempty"`
 }
 
+// Return true if the binding may be omitted
+func (b Binding) IsOptional() bool {
+	return b.Optional != nil && *b.Optional
+}
+
 // Bind an input to the given environment
 func (input Binding) BindInput(env *dagger.Env, call *Call) (*dagger.Env, error) {
 	desc := input.Description
 	if input.Instructions != nil {
 		desc += "\n" + *input.Instructions
 	}
-	switch input.Typename {
-	case "String":
-		s, err := call.StringArg(input.Name)
+	if !call.HasArg(input.Name) {
+		if input.IsOptional() {
+			return env, nil
+		}
+		return nil, fmt.Errorf("missing required input: %q", input.Name)
+	}
+	if elem, isList := listElement(input.Typename); isList {
+		// The environment has no list inputs: each item is bound as its own input
+		items, err := call.ListArg(input.Name)
 		if err != nil {
-			if input.Optional != nil && *input.Optional {
-				return env, nil
-			}
 			return nil, err
 		}
-		return env.WithStringInput(input.Name, s, desc), nil
-	case "Directory":
-		dir, err := call.DirectoryArg(input.Name)
-		if err != nil {
-			if input.Optional != nil && *input.Optional {
-				return env, nil
+		for i, item := range items {
+			itemName := fmt.Sprintf("%s_%d", input.Name, i+1)
+			itemBinding := Binding{
+				Name:        itemName,
+				Typename:    elem,
+				Description: fmt.Sprintf("%s (item %d of %d)", desc, i+1, len(items)),
+			}
+			env, err = itemBinding.BindInput(env, &Call{args: map[string][]byte{itemName: item}})
+			if err != nil {
+				return nil, err
 			}
-			return nil, err
 		}
-		return env.WithDirectoryInput(input.Name, dir, desc), nil
+		return env, nil
+	}
+	var (
+		value any
+		err   error
+	)
+	switch input.Typename {
+	case "String":
+		value, err = call.StringArg(input.Name)
+	case "Int", "Integer":
+		value, err = call.IntArg(input.Name)
+	case "Bool":
+		value, err = call.BoolArg(input.Name)
+	case "Directory":
+		value, err = call.DirectoryArg(input.Name)
+	case "File":
+		value, err = call.FileArg(input.Name)
+	case "Container":
+		value, err = call.ContainerArg(input.Name)
+	case "Secret":
+		value, err = call.SecretArg(input.Name)
+	case "Service":
+		value, err = call.ServiceArg(input.Name)
+	default:
+		return nil, fmt.Errorf("Unsupported input type: %s", input.Typename)
 	}
-	return nil, fmt.Errorf("Unsupported input type: %s", input.Typename)
+	if err != nil {
+		return nil, err
+	}
+	return withInput(env, input.Name, value, desc)
+}
+
+// Bind a value as an input of an environment: an argument of the action, or an output of a previous step
+func withInput(env *dagger.Env, name string, value any, desc string) (*dagger.Env, error) {
+	switch value := value.(type) {
+	case nil:
+		// Void outputs have no value
+		return env, nil
+	case string:
+		return env.WithStringInput(name, value, desc), nil
+	case int:
+		// The environment has no integer inputs
+		return env.WithStringInput(name, strconv.Itoa(value), desc), nil
+	case bool:
+		// The environment has no boolean inputs
+		return env.WithStringInput(name, strconv.FormatBool(value), desc), nil
+	case *dagger.Directory:
+		return env.WithDirectoryInput(name, value, desc), nil
+	case *dagger.File:
+		return env.WithFileInput(name, value, desc), nil
+	case *dagger.Container:
+		return env.WithContainerInput(name, value, desc), nil
+	case *dagger.Secret:
+		return env.WithSecretInput(name, value, desc), nil
+	case *dagger.Service:
+		return env.WithServiceInput(name, value, desc), nil
+	}
+	return nil, fmt.Errorf("unsupported input value: %T", value)
 }
 
 func (output Binding) BindOutput(env *dagger.Env) (*dagger.Env, error) {
@@ -257,23 +411,105 @@ func (output Binding) BindOutput(env *dagger.Env) (*dagger.Env, error) {
 	if output.Instructions != nil {
 		desc += "\n" + *output.Instructions
 	}
-	// FIXME: support more than directory
-	return env.WithDirectoryOutput(output.Name, desc), nil
+	switch output.Typename {
+	case "String", "Int", "Integer", "Bool":
+		// The environment has no scalar outputs: the value is returned as the contents of a file
+		return env.WithFileOutput(output.Name, fmt.Sprintf(
+			"%s\nReturn the value as the contents of a new file: a %s, and nothing else.",
+			desc, scalarDescriptions[output.Typename],
+		)), nil
+	case "Directory":
+		return env.WithDirectoryOutput(output.Name, desc), nil
+	case "File":
+		return env.WithFileOutput(output.Name, desc), nil
+	case "Container":
+		return env.WithContainerOutput(output.Name, desc), nil
+	case "Secret":
+		return env.WithSecretOutput(output.Name, desc), nil
+	case "Service":
+		return env.WithServiceOutput(output.Name, desc), nil
+	case "Void":
+		// Nothing to return
+		return env, nil
+	}
+	return nil, fmt.Errorf("unsupported output type: %s", output.Typename)
+}
+
+// How scalar values are written, when returned as file contents
+var scalarDescriptions = map[string]string{
+	"String":  "string",
+	"Int":     "decimal integer",
+	"Integer": "decimal integer",
+	"Bool":    `boolean, "true" or "false"`,
 }
 
+// Return the value of an output of an environment, as returned by the action
 func (output Binding) OutputValue(env *dagger.Env) (any, error) {
+	value, err := output.value(env)
+	if err != nil {
+		return nil, err
+	}
+	// Objects are returned by ID
+	switch value := value.(type) {
+	case *dagger.Directory:
+		return value.ID(ctx)
+	case *dagger.File:
+		return value.ID(ctx)
+	case *dagger.Container:
+		return value.ID(ctx)
+	case *dagger.Secret:
+		return value.ID(ctx)
+	case *dagger.Service:
+		return value.ID(ctx)
+	}
+	return value, nil
+}
+
+// Return the value of an output of an environment: a scalar, an object, or nil for void outputs
+func (output Binding) value(env *dagger.Env) (any, error) {
 	binding := env.Output(output.Name)
 	switch output.Typename {
+	case "String", "Int", "Integer", "Bool":
+		contents, err := binding.AsFile().Contents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return output.scalarValue(contents)
 	case "Directory":
-		return binding.AsDirectory().ID(ctx)
+		return binding.AsDirectory(), nil
 	case "File":
-		return binding.AsFile().ID(ctx)
+		return binding.AsFile(), nil
 	case "Container":
-		return binding.AsContainer().ID(ctx)
+		return binding.AsContainer(), nil
+	case "Secret":
+		return binding.AsSecret(), nil
+	case "Service":
+		return binding.AsService(), nil
+	case "Void":
+		return nil, nil
 	}
 	return nil, fmt.Errorf("unsupported output type: %s", output.Typename)
 }
 
+// Parse a scalar output value from the contents of the file it was returned in
+func (output Binding) scalarValue(contents string) (any, error) {
+	switch output.Typename {
+	case "Int", "Integer":
+		i, err := strconv.Atoi(strings.TrimSpace(contents))
+		if err != nil {
+			return nil, fmt.Errorf("output %q: not an integer: %q", output.Name, contents)
+		}
+		return i, nil
+	case "Bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(contents))
+		if err != nil {
+			return nil, fmt.Errorf("output %q: not a boolean: %q", output.Name, contents)
+		}
+		return b, nil
+	}
+	return contents, nil
+}
+
 func (b Binding) Type() (*dagger.TypeDef, error) {
 	switch b.Typename {
 	case "String":
@@ -284,6 +520,8 @@ func (b Binding) Type() (*dagger.TypeDef, error) {
 		return dag.TypeDef().WithKind(dagger.TypeDefKindBooleanKind), nil
 	case "Directory":
 		return dag.TypeDef().WithObject("Directory"), nil
+	case "File":
+		return dag.TypeDef().WithObject("File"), nil
 	case "Container":
 		return dag.TypeDef().WithObject("Container"), nil
 	case "Secret":
@@ -293,5 +531,13 @@ func (b Binding) Type() (*dagger.TypeDef, error) {
 	case "Void":
 		return dag.TypeDef().WithKind(dagger.TypeDefKindVoidKind), nil
 	}
+	// Only inputs can be lists: the schema rejects list outputs
+	if elem, isList := listElement(b.Typename); isList {
+		elemType, err := Binding{Typename: elem}.Type()
+		if err != nil {
+			return nil, err
+		}
+		return dag.TypeDef().WithListOf(elemType), nil
+	}
 	return nil, fmt.Errorf("unknown type: %q", b.Typename)
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// The prompt of actions and steps, unless the action or the agent has a prompt template
+const defaultPromptTemplate = `You are {{.Agent}}, a helpful assistant. Your task is: <task>{{.Task}}</task>
+To accomplish your task, you are given access to all the tools you need. Use them, don't tell the user to use them.
+When you are finished, use the 'return' tool to return the required outputs to the user.
+Take care to read the descriptions of your available tools, as well as the required arguments for the return tool.
+They are important to accomplish your task.
+Again, your task is: <task>{{.Task}}</task>
+{{- with .Step}}
+Your task is step {{.Number}} of {{.Count}}, {{printf "%q" .Name}}, of a larger task: <goal>{{$.Description}}</goal>
+Only do your step: the next steps are done separately, with the outputs you return.
+{{- end}}`
+
+// The data of prompt templates
+type PromptData struct {
+	// The name of the agent
+	Agent string
+	// The name and description of the action
+	Action      string
+	Description string
+	// The task of the step: its prompt, or the action description for actions without steps
+	Task string
+	// The step, or nil for actions without steps
+	Step *PromptStep
+	// The inputs of the action, in order, and by name
+	Inputs []PromptBinding
+	Input  map[string]PromptBinding
+	// The outputs of the step, in order, and by name
+	Outputs []PromptBinding
+	Output  map[string]PromptBinding
+}
+
+type PromptStep struct {
+	Name string
+	// The position of the step, from 1
+	Number int
+	// The number of steps of the action
+	Count int
+}
+
+// An input or output, in prompt templates
+type PromptBinding struct {
+	Name        string
+	Type        string
+	Description string
+	// The value of string, integer and boolean inputs, and of lists of them.
+	// Nil for objects, outputs, and omitted inputs.
+	Value any
+}
+
+// Return the template functions, reading files from the given directory
+func promptFuncs(dir string) template.FuncMap {
+	return template.FuncMap{
+		// Include a file of the module, eg. {{file "prompts/review.md"}}
+		"file": func(name string) (string, error) {
+			if !filepath.IsLocal(name) {
+				return "", fmt.Errorf("file %q: not in the module directory", name)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		},
+	}
+}
+
+func parsePromptTemplate(name, text, dir string) (*template.Template, error) {
+	return template.New(name).Funcs(promptFuncs(dir)).Option("missingkey=error").Parse(text)
+}
+
+// Return the prompt template of the action: its own, the agent's, or the default one
+func (action *Action) promptTemplate() string {
+	if action.PromptTemplate != "" {
+		return action.PromptTemplate
+	}
+	if action.agent.PromptTemplate != "" {
+		return action.agent.PromptTemplate
+	}
+	return defaultPromptTemplate
+}
+
+// Return the system prompt template of the action: its own, the agent's, or none
+func (action *Action) systemPrompt() string {
+	if action.SystemPrompt != "" {
+		return action.SystemPrompt
+	}
+	return action.agent.SystemPrompt
+}
+
+// Render a prompt template of the action
+func (action *Action) renderPrompt(name, text string, data *PromptData) (string, error) {
+	tmpl, err := parsePromptTemplate(name, text, action.agent.dir)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Return the data of the prompt templates of a step
+func (action *Action) promptData(call *Call, step *Step, index int) (*PromptData, error) {
+	data := &PromptData{
+		Agent:       action.agent.Name,
+		Action:      action.Name,
+		Description: action.Description,
+		Task:        step.Prompt,
+		Input:       map[string]PromptBinding{},
+		Output:      map[string]PromptBinding{},
+	}
+	if len(action.Steps) > 0 {
+		data.Step = &PromptStep{
+			Name:   step.Name,
+			Number: index + 1,
+			Count:  len(action.Steps),
+		}
+	}
+	for _, input := range action.Inputs {
+		value, err := input.promptValue(call)
+		if err != nil {
+			return nil, err
+		}
+		b := PromptBinding{
+			Name:        input.Name,
+			Type:        input.Typename,
+			Description: input.Description,
+			Value:       value,
+		}
+		data.Inputs = append(data.Inputs, b)
+		data.Input[input.Name] = b
+	}
+	for _, output := range step.Outputs {
+		b := PromptBinding{
+			Name:        output.Name,
+			Type:        output.Typename,
+			Description: output.Description,
+		}
+		data.Outputs = append(data.Outputs, b)
+		data.Output[output.Name] = b
+	}
+	return data, nil
+}
+
+// Return the value of a scalar input, or of a list of scalars, for prompt templates
+func (input Binding) promptValue(call *Call) (any, error) {
+	if !call.HasArg(input.Name) {
+		return nil, nil
+	}
+	switch input.Typename {
+	case "String":
+		return call.StringArg(input.Name)
+	case "Int", "Integer":
+		return call.IntArg(input.Name)
+	case "Bool":
+		return call.BoolArg(input.Name)
+	case "[String]", "[Int]", "[Integer]", "[Bool]":
+		var values []any
+		return values, call.decodeArg(input.Name, &values)
+	}
+	return nil, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import "dagger.io/dagger"
+
+// A step of an action: an LLM loop with its own prompt, model and tools.
+// Steps run in order. Each step is given the action inputs and the outputs of the
+// previous steps, and the action outputs are taken from the outputs of its steps.
+type Step struct {
+	Name   string `yaml:"name"`
+	Prompt string `yaml:"prompt"`
+	Model  string `yaml:"model,omitempty"`
+	// The names of the action inputs and previous step outputs given to the step.
+	// All of them if empty.
+	Tools   []string   `yaml:"tools,omitempty"`
+	Outputs []*Binding `yaml:"outputs,omitempty"`
+}
+
+// Return the steps of the action. An action without steps is a single step.
+func (action *Action) pipeline() []*Step {
+	if len(action.Steps) > 0 {
+		return action.Steps
+	}
+	return []*Step{{
+		Name:    action.Name,
+		Prompt:  action.Description,
+		Model:   action.Model,
+		Outputs: action.Outputs,
+	}}
+}
+
+// Return true if the step is given the input or previous output with the given name
+func (step *Step) uses(name string) bool {
+	if len(step.Tools) == 0 {
+		return true
+	}
+	for _, tool := range step.Tools {
+		if tool == name {
+			return true
+		}
+	}
+	return false
+}
+
+// An output produced by a step
+type stepOutput struct {
+	binding *Binding
+	// The environment of the step, once run
+	env *dagger.Env
+}
+
+// The outputs produced by steps, in order
+type stepOutputs []stepOutput
+
+func (outs stepOutputs) get(name string) (stepOutput, bool) {
+	for _, out := range outs {
+		if out.binding.Name == name {
+			return out, true
+		}
+	}
+	return stepOutput{}, false
+}
+
+// Add an output. It replaces an output with the same name, produced by a previous step.
+func (outs *stepOutputs) set(out stepOutput) {
+	for i := range *outs {
+		if (*outs)[i].binding.Name == out.binding.Name {
+			(*outs)[i] = out
+			return
+		}
+	}
+	*outs = append(*outs, out)
+}
+
+// Bind an output of a step's environment as an input of another environment
+func (output Binding) BindFrom(env *dagger.Env, from *dagger.Env) (*dagger.Env, error) {
+	value, err := output.value(from)
+	if err != nil {
+		return nil, err
+	}
+	return withInput(env, output.Name, value, output.Description)
+}
@@ -88,33 +88,83 @@ func (call *Call) ReturnError(ctx context.Context, err error) error {
 	return call.fnCall.ReturnError(ctx, dag.Error(unwrapError(err)))
 }
 
-func (call *Call) DirectoryArg(name string) (*dagger.Directory, error) {
+// Return true if the call has a value for the given argument.
+// Omitted optional arguments have no value, or a null value.
+func (call *Call) HasArg(name string) bool {
 	data, ok := call.args[name]
-	if !ok {
-		// FIXME: we are hardcoding an empty directory as default value
-		// AND assuming that required arguments are enforced upstream
-		return dag.Directory(), nil
+	return ok && data != nil && string(data) != "null"
+}
+
+// Decode the JSON value of an argument
+func (call *Call) decodeArg(name string, v any) error {
+	if !call.HasArg(name) {
+		return fmt.Errorf("arg not found: %q", name)
 	}
-	if data == nil {
-		return dag.Directory(), nil
+	if err := json.Unmarshal(call.args[name], v); err != nil {
+		return fmt.Errorf("arg %q: %w", name, err)
 	}
+	return nil
+}
+
+func (call *Call) StringArg(name string) (string, error) {
+	var s string
+	return s, call.decodeArg(name, &s)
+}
+
+func (call *Call) IntArg(name string) (int, error) {
+	var i int
+	return i, call.decodeArg(name, &i)
+}
+
+func (call *Call) BoolArg(name string) (bool, error) {
+	var b bool
+	return b, call.decodeArg(name, &b)
+}
+
+// Return the JSON values of the items of a list argument
+func (call *Call) ListArg(name string) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	return items, call.decodeArg(name, &items)
+}
+
+func (call *Call) DirectoryArg(name string) (*dagger.Directory, error) {
 	var id dagger.DirectoryID
-	if err := json.Unmarshal(data, &id); err != nil {
+	if err := call.decodeArg(name, &id); err != nil {
 		return nil, err
 	}
 	return dag.LoadDirectoryFromID(id), nil
 }
 
-func (call *Call) StringArg(name string) (string, error) {
-	data, ok := call.args[name]
-	if !ok {
-		return "", fmt.Errorf("arg not found: %q", name)
+func (call *Call) FileArg(name string) (*dagger.File, error) {
+	var id dagger.FileID
+	if err := call.decodeArg(name, &id); err != nil {
+		return nil, err
 	}
-	var s string
-	if err := json.Unmarshal(data, &s); err != nil {
-		return "", err
+	return dag.LoadFileFromID(id), nil
+}
+
+func (call *Call) ContainerArg(name string) (*dagger.Container, error) {
+	var id dagger.ContainerID
+	if err := call.decodeArg(name, &id); err != nil {
+		return nil, err
+	}
+	return dag.LoadContainerFromID(id), nil
+}
+
+func (call *Call) SecretArg(name string) (*dagger.Secret, error) {
+	var id dagger.SecretID
+	if err := call.decodeArg(name, &id); err != nil {
+		return nil, err
+	}
+	return dag.LoadSecretFromID(id), nil
+}
+
+func (call *Call) ServiceArg(name string) (*dagger.Service, error) {
+	var id dagger.ServiceID
+	if err := call.decodeArg(name, &id); err != nil {
+		return nil, err
 	}
-	return s, nil
+	return dag.LoadServiceFromID(id), nil
 }
 
 // Utility function during module invocation when an error it returned.
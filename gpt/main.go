@@ -28,14 +28,10 @@ func New(
 	systemPrompt *dagger.File,
 ) (Gpt, error) {
 	gpt := Gpt{
-		Token: token,
-		Model: model,
+		Token:   token,
+		Model:   model,
+		Sandbox: dag.Sandbox().WithUsername("🤖").ImportManuals(knowledgeDir),
 	}
-	sandbox, err := NewSandbox().WithUsername("🤖").ImportManuals(ctx, knowledgeDir)
-	if err != nil {
-		return gpt, err
-	}
-	gpt.Sandbox = sandbox
 	prompt, err := systemPrompt.Contents(ctx)
 	if err != nil {
 		return gpt, err
@@ -44,15 +40,10 @@ func New(
 }
 
 type Gpt struct {
-	Model       ModelName      // +private
-	Token       *dagger.Secret // +private
-	HistoryJSON string         // +private
-	Sandbox     Sandbox
-}
-
-func (m Gpt) WithSandbox(sandbox Sandbox) Gpt {
-	m.Sandbox = sandbox
-	return m
+	Model       ModelName       // +private
+	Token       *dagger.Secret  // +private
+	HistoryJSON string          // +private
+	Sandbox     *dagger.Sandbox // +private
 }
 
 func (m Gpt) WithSecret(name string, value *dagger.Secret) Gpt {
@@ -61,7 +52,7 @@ func (m Gpt) WithSecret(name string, value *dagger.Secret) Gpt {
 }
 
 func (m Gpt) WithDirectory(dir *dagger.Directory) Gpt {
-	m.Sandbox = m.Sandbox.WithHome(m.Sandbox.Home.WithDirectory(".", dir))
+	m.Sandbox = m.Sandbox.WithHome(m.Sandbox.Home().WithDirectory(".", dir))
 	return m
 }
 
@@ -77,13 +68,18 @@ func (m Gpt) WithLocalModule(module *dagger.Directory) Gpt {
 	return m
 }
 
-func (m Gpt) History() []string {
-	return m.Sandbox.History
+// The sandbox's home directory
+func (m Gpt) Directory() *dagger.Directory {
+	return m.Sandbox.Home()
+}
+
+func (m Gpt) History(ctx context.Context) ([]string, error) {
+	return m.Sandbox.History(ctx)
 }
 
 func (m Gpt) withReply(ctx context.Context, message openai.ChatCompletionMessage) Gpt {
 	if len(message.Content) != 0 {
-		m.Sandbox = m.Sandbox.WithNote(ctx, message.Content, "")
+		m.Sandbox = m.Sandbox.WithNote(message.Content)
 	}
 	hist := m.loadHistory(ctx)
 	hist = append(hist, message)
@@ -100,14 +96,14 @@ func (m Gpt) WithToolOutput(ctx context.Context, callId, content string) Gpt {
 }
 
 func (m Gpt) WithPrompt(ctx context.Context, prompt string) Gpt {
-	m.Sandbox = m.Sandbox.WithNote(ctx, prompt, "🧑")
+	m.Sandbox = m.Sandbox.WithNote(prompt, dagger.SandboxWithNoteOpts{Username: "🧑"})
 	hist := m.loadHistory(ctx)
 	hist = append(hist, openai.UserMessage(prompt))
 	return m.saveHistory(hist)
 }
 
 func (m Gpt) WithSystemPrompt(ctx context.Context, prompt string) Gpt {
-	m.Sandbox = m.Sandbox.WithNote(ctx, prompt, "🧬")
+	m.Sandbox = m.Sandbox.WithNote(prompt, dagger.SandboxWithNoteOpts{Username: "🧬"})
 	hist := m.loadHistory(ctx)
 	hist = append(hist, openai.SystemMessage(prompt))
 	return m.saveHistory(hist)
@@ -143,25 +139,18 @@ func (m Gpt) Ask(
 				if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
 					return m, err
 				}
-				m.Sandbox, err = m.Sandbox.Run(ctx, args["command"].(string))
-				if err != nil {
-					return m, err
-				}
-				run, err := m.Sandbox.LastRun()
-				if err != nil {
-					return m, err
-				}
-				result, err := run.ResultJSON()
+				m.Sandbox = m.Sandbox.Run(args["command"].(string))
+				result, err := m.Sandbox.Result(ctx)
 				if err != nil {
 					return m, err
 				}
 				m = m.WithToolOutput(ctx, call.ID, result)
 			default:
-				manual, err := m.Sandbox.Manual(ctx, call.Function.Name)
+				manual, err := m.Sandbox.ReadManual(ctx, call.Function.Name)
 				if err != nil {
 					return m, err
 				}
-				m = m.WithToolOutput(ctx, call.ID, manual.Contents)
+				m = m.WithToolOutput(ctx, call.ID, manual)
 			}
 		}
 	}
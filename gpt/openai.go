@@ -84,16 +84,24 @@ func (m Gpt) oaiQuery(ctx context.Context) (comp *openai.ChatCompletion, rerr er
 		}),
 	}
 	tools := []openai.ChatCompletionToolParam{runTool}
-	manuals := m.Sandbox.Manuals
+	manuals, err := m.Sandbox.Manuals(ctx)
 	if err != nil {
 		return nil, err
 	}
 	for _, man := range manuals {
+		name, err := man.Name(ctx)
+		if err != nil {
+			return nil, err
+		}
+		description, err := man.Description(ctx)
+		if err != nil {
+			return nil, err
+		}
 		tools = append(tools, openai.ChatCompletionToolParam{
 			Type: openai.F(openai.ChatCompletionToolTypeFunction),
 			Function: openai.F(openai.FunctionDefinitionParam{
-				Name:        openai.String(man.Key),
-				Description: openai.String(man.Description),
+				Name:        openai.String(name),
+				Description: openai.String(description),
 			}),
 		})
 	}
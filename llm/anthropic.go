@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"dagger/llm/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	anthropicBaseURL   = "https://api.anthropic.com"
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 4096
+	// Name of the tool forced in structured output mode
+	anthropicOutputTool = "output"
+)
+
+type Anthropic struct{}
+
+func (a Anthropic) Name() string {
+	return "anthropic"
+}
+
+func (a Anthropic) IsModel(model string) bool {
+	return strings.HasPrefix(model, "claude-")
+}
+
+// Claude 3 models accept images, except Claude 3.5 Haiku
+func (a Anthropic) Vision(model string) bool {
+	for _, prefix := range []string{"claude-2", "claude-instant", "claude-3-5-haiku"} {
+		if strings.HasPrefix(model, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// List the models offered by the endpoint
+func (a Anthropic) Models(ctx context.Context, baseURL string, token *dagger.Secret) ([]string, error) {
+	var res struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := anthropicRequestJSON(ctx, baseURL, token, http.MethodGet, "/v1/models?limit=1000", nil, &res); err != nil {
+		return nil, err
+	}
+	var models []string
+	for _, model := range res.Data {
+		models = append(models, model.ID)
+	}
+	return models, nil
+}
+
+func (a Anthropic) New() LlmState {
+	return AnthropicState{}
+}
+
+func (a Anthropic) Load(data string) (LlmState, error) {
+	var st AnthropicState
+	if data == "" {
+		return st, nil
+	}
+	if err := json.Unmarshal([]byte(data), &st); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// State of an Anthropic session, safely serializable
+type AnthropicState struct {
+	// The Messages API takes the system prompt separately from the conversation
+	System   string             `json:"system,omitempty"`
+	Messages []anthropicMessage `json:"messages"`
+}
+
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+// A single content block. The fields in use depend on the block type:
+// "text", "tool_use" or "tool_result".
+type anthropicContentBlock struct {
+	Type string `json:"type"`
+	// text
+	Text string `json:"text,omitempty"`
+	// image
+	Source *anthropicImageSource `json:"source,omitempty"`
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// tool_result
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+}
+
+type anthropicImageSource struct {
+	// "base64"
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model      string               `json:"model"`
+	MaxTokens  int                  `json:"max_tokens"`
+	System     string               `json:"system,omitempty"`
+	Messages   []anthropicMessage   `json:"messages"`
+	Tools      []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Stream     bool                 `json:"stream,omitempty"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID         string                  `json:"id"`
+	Role       string                  `json:"role"`
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (u anthropicUsage) tokenUsage() TokenUsage {
+	return TokenUsage{
+		PromptTokens:     u.InputTokens,
+		CompletionTokens: u.OutputTokens,
+	}
+}
+
+// A server-sent event of a streaming response
+type anthropicStreamEvent struct {
+	Type         string                `json:"type"`
+	Index        int                   `json:"index"`
+	Message      anthropicResponse     `json:"message"`
+	ContentBlock anthropicContentBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicError struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Append a user message (prompt) to the message history
+func (st AnthropicState) WithPrompt(prompt string) LlmState {
+	return st.withUserContent(anthropicContentBlock{
+		Type: "text",
+		Text: prompt,
+	})
+}
+
+func (st AnthropicState) WithPromptContent(parts []ContentPart) LlmState {
+	return st.withUserContent(anthropicContentBlocks(parts)...)
+}
+
+// Append to the system prompt, which is sent separately from the messages
+func (st AnthropicState) WithSystemPrompt(prompt string) LlmState {
+	if st.System == "" {
+		st.System = prompt
+	} else {
+		st.System += "\n\n" + prompt
+	}
+	return st
+}
+
+// Return the message history in a provider-agnostic form.
+// Tool results are split from their user turn into tool messages, in order.
+func (st AnthropicState) History() ([]Message, error) {
+	var messages []Message
+	if st.System != "" {
+		messages = append(messages, Message{Role: "system", Content: textContent(st.System)})
+	}
+	for _, msg := range st.Messages {
+		current := Message{Role: msg.Role}
+		flush := func() {
+			if len(current.Content) > 0 || len(current.ToolCalls) > 0 {
+				messages = append(messages, current)
+			}
+			current = Message{Role: msg.Role}
+		}
+		for _, block := range msg.Content {
+			switch block.Type {
+			case "text":
+				current.Content = append(current.Content, ContentPart{Type: "text", Text: block.Text})
+			case "image":
+				if block.Source == nil {
+					return nil, fmt.Errorf("image without a source in a %s message", msg.Role)
+				}
+				current.Content = append(current.Content, ContentPart{
+					Type:      "image",
+					MediaType: block.Source.MediaType,
+					Data:      block.Source.Data,
+				})
+			case "tool_use":
+				input := string(block.Input)
+				if input == "" {
+					input = "{}"
+				}
+				current.ToolCalls = append(current.ToolCalls, ToolCall{ID: block.ID, Name: block.Name, Arguments: input})
+			case "tool_result":
+				flush()
+				messages = append(messages, Message{
+					Role:       "tool",
+					Content:    textContent(block.Content),
+					ToolCallID: block.ToolUseID,
+					IsError:    block.IsError,
+				})
+			default:
+				return nil, fmt.Errorf("unsupported content block %q in a %s message", block.Type, msg.Role)
+			}
+		}
+		flush()
+	}
+	return messages, nil
+}
+
+// Replace the message history
+func (st AnthropicState) WithHistory(messages []Message) LlmState {
+	st.System = ""
+	st.Messages = nil
+	for _, msg := range messages {
+		switch msg.Role {
+		case "system":
+			st = st.WithSystemPrompt(msg.Text()).(AnthropicState)
+		case "user":
+			st = st.withUserContent(anthropicContentBlocks(msg.Content)...)
+		case "tool":
+			st = st.withUserContent(anthropicContentBlock{
+				Type:      "tool_result",
+				ToolUseID: msg.ToolCallID,
+				Content:   msg.Text(),
+				IsError:   msg.IsError,
+			})
+		case "assistant":
+			blocks := anthropicContentBlocks(msg.Content)
+			for _, call := range msg.ToolCalls {
+				input := call.Arguments
+				if input == "" {
+					input = "{}"
+				}
+				blocks = append(blocks, anthropicContentBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Name,
+					Input: json.RawMessage(input),
+				})
+			}
+			st.Messages = append(st.Messages, anthropicMessage{Role: "assistant", Content: blocks})
+		}
+	}
+	return st
+}
+
+// Convert content parts to text and image blocks. The API rejects empty text blocks.
+func anthropicContentBlocks(parts []ContentPart) []anthropicContentBlock {
+	var blocks []anthropicContentBlock
+	for _, part := range parts {
+		switch {
+		case part.Type == "text" && part.Text != "":
+			blocks = append(blocks, anthropicContentBlock{Type: "text", Text: part.Text})
+		case part.Type == "image":
+			blocks = append(blocks, anthropicContentBlock{
+				Type: "image",
+				Source: &anthropicImageSource{
+					Type:      "base64",
+					MediaType: part.MediaType,
+					Data:      part.Data,
+				},
+			})
+		}
+	}
+	return blocks
+}
+
+// Append content blocks to the user turn. The Messages API expects user and
+// assistant turns to alternate, so consecutive user content is merged.
+func (st AnthropicState) withUserContent(blocks ...anthropicContentBlock) AnthropicState {
+	// Copy the message list, so that states derived from each other don't share content slices
+	st.Messages = append([]anthropicMessage(nil), st.Messages...)
+	if n := len(st.Messages); n > 0 && st.Messages[n-1].Role == "user" {
+		last := st.Messages[n-1]
+		last.Content = append(append([]anthropicContentBlock(nil), last.Content...), blocks...)
+		st.Messages[n-1] = last
+		return st
+	}
+	st.Messages = append(st.Messages, anthropicMessage{
+		Role:    "user",
+		Content: blocks,
+	})
+	return st
+}
+
+// Send a messages API query, process tool calls, and return the reply text
+func (st AnthropicState) Query(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	tools []Tool,
+) (QueryResult, LlmState, error) {
+	res, err := st.sendQuery(ctx, baseURL, token, st.request(model, tools))
+	if err != nil {
+		return QueryResult{}, st, err
+	}
+	return st.processReply(ctx, res, tools)
+}
+
+// Send a streaming messages API query, process tool calls, and return the reply text
+func (st AnthropicState) QueryStream(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	tools []Tool,
+	onDelta func(string),
+) (QueryResult, LlmState, error) {
+	res, err := st.sendQueryStream(ctx, baseURL, token, st.request(model, tools), onDelta)
+	if err != nil {
+		return QueryResult{}, st, err
+	}
+	return st.processReply(ctx, res, tools)
+}
+
+// Send a messages API query in structured output mode, and return the reply JSON.
+// The Messages API has no JSON mode: the model is forced to call a tool
+// taking the schema as input, and the input is the reply.
+func (st AnthropicState) QueryStructured(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	schema map[string]interface{},
+) (QueryResult, LlmState, error) {
+	// Tool inputs must be objects: wrap other schemas in a property
+	wrapped := schema["type"] != "object"
+	if wrapped {
+		schema = map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"value": schema},
+			"required":   []string{"value"},
+		}
+	}
+	req := st.request(model, nil)
+	req.Tools = []anthropicTool{{
+		Name:        anthropicOutputTool,
+		Description: "Reply with structured output",
+		InputSchema: schema,
+	}}
+	req.ToolChoice = &anthropicToolChoice{Type: "tool", Name: anthropicOutputTool}
+	res, err := st.sendQuery(ctx, baseURL, token, req)
+	if err != nil {
+		return QueryResult{}, st, err
+	}
+	result := QueryResult{
+		Usage: res.Usage.tokenUsage(),
+	}
+	for _, block := range res.Content {
+		if block.Type == "tool_use" && block.Name == anthropicOutputTool {
+			result.Reply = string(block.Input)
+			break
+		}
+	}
+	if wrapped {
+		var output struct {
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal([]byte(result.Reply), &output); err == nil {
+			result.Reply = string(output.Value)
+		}
+	}
+	// Keep the reply as text, so that the history doesn't wait for a tool result
+	st.Messages = append(st.Messages, anthropicMessage{
+		Role:    "assistant",
+		Content: []anthropicContentBlock{{Type: "text", Text: result.Reply}},
+	})
+	return result, st, nil
+}
+
+// Add the model reply to the history, and handle its tool calls
+func (st AnthropicState) processReply(ctx context.Context, res *anthropicResponse, tools []Tool) (QueryResult, LlmState, error) {
+	result := QueryResult{
+		Usage: res.Usage.tokenUsage(),
+	}
+	st.Messages = append(st.Messages, anthropicMessage{
+		Role:    "assistant",
+		Content: res.Content,
+	})
+	var (
+		reply []string
+		calls []ToolCall
+	)
+	for _, block := range res.Content {
+		switch block.Type {
+		case "text":
+			reply = append(reply, block.Text)
+		case "tool_use":
+			input := string(block.Input)
+			if input == "" {
+				input = "{}"
+			}
+			calls = append(calls, ToolCall{ID: block.ID, Name: block.Name, Arguments: input})
+		}
+	}
+	result.Reply = strings.Join(reply, "\n")
+	outputs, err := callTools(ctx, calls, tools)
+	if err != nil {
+		return result, st, err
+	}
+	// Tool results are sent back in a single user turn
+	var results []anthropicContentBlock
+	for i, call := range calls {
+		results = append(results, anthropicContentBlock{
+			Type:      "tool_result",
+			ToolUseID: call.ID,
+			Content:   outputs[i].Output,
+			IsError:   outputs[i].IsError,
+		})
+	}
+	if len(results) > 0 {
+		st = st.withUserContent(results...)
+	}
+	return result, st, nil
+}
+
+func (st AnthropicState) sendQuery(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	req anthropicRequest,
+) (res *anthropicResponse, rerr error) {
+	ctx, span := Tracer().Start(ctx, "[🤖] 💭")
+	defer func() {
+		if rerr != nil {
+			span.SetStatus(codes.Error, rerr.Error())
+		}
+		span.End()
+	}()
+	res = new(anthropicResponse)
+	if err := anthropicRequestJSON(ctx, baseURL, token, http.MethodPost, "/v1/messages", req, res); err != nil {
+		return nil, err
+	}
+	recordUsage(span, res.Usage.tokenUsage())
+	return res, nil
+}
+
+func (st AnthropicState) sendQueryStream(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	req anthropicRequest,
+	onDelta func(string),
+) (res *anthropicResponse, rerr error) {
+	ctx, span := Tracer().Start(ctx, "[🤖] 💭")
+	defer func() {
+		if rerr != nil {
+			span.SetStatus(codes.Error, rerr.Error())
+		}
+		span.End()
+	}()
+	req.Stream = true
+	httpRes, err := anthropicDo(ctx, baseURL, token, http.MethodPost, "/v1/messages", req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+	write, done := streamToSpan(ctx, onDelta)
+	defer done()
+	res = new(anthropicResponse)
+	// Tool inputs arrive as partial JSON strings, concatenated until the block stops
+	partialInputs := map[int]*strings.Builder{}
+	scanner := bufio.NewScanner(httpRes.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("anthropic: malformatted stream event: %w", err)
+		}
+		switch event.Type {
+		case "message_start":
+			res.ID = event.Message.ID
+			res.Role = event.Message.Role
+			res.Usage = event.Message.Usage
+		case "content_block_start":
+			if event.Index != len(res.Content) {
+				return nil, fmt.Errorf("anthropic: unexpected content block index %d", event.Index)
+			}
+			block := event.ContentBlock
+			if block.Type == "tool_use" {
+				block.Input = nil
+				partialInputs[event.Index] = new(strings.Builder)
+			}
+			res.Content = append(res.Content, block)
+		case "content_block_delta":
+			if event.Index >= len(res.Content) {
+				return nil, fmt.Errorf("anthropic: delta for unknown content block %d", event.Index)
+			}
+			switch event.Delta.Type {
+			case "text_delta":
+				res.Content[event.Index].Text += event.Delta.Text
+				write(event.Delta.Text)
+			case "input_json_delta":
+				if input, ok := partialInputs[event.Index]; ok {
+					input.WriteString(event.Delta.PartialJSON)
+				}
+			}
+		case "content_block_stop":
+			if input, ok := partialInputs[event.Index]; ok {
+				// Calls without arguments may have no input deltas,
+				// but the input is required when the call is sent back
+				res.Content[event.Index].Input = json.RawMessage("{}")
+				if input.Len() > 0 {
+					res.Content[event.Index].Input = json.RawMessage(input.String())
+				}
+			}
+		case "message_delta":
+			res.StopReason = event.Delta.StopReason
+			// Output token counts are cumulative
+			res.Usage.OutputTokens = event.Usage.OutputTokens
+		case "error":
+			return nil, fmt.Errorf("anthropic: %s: %s", event.Error.Type, event.Error.Message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	recordUsage(span, res.Usage.tokenUsage())
+	return res, nil
+}
+
+func (st AnthropicState) request(model string, tools []Tool) anthropicRequest {
+	req := anthropicRequest{
+		Model:     model,
+		MaxTokens: anthropicMaxTokens,
+		System:    st.System,
+		Messages:  st.Messages,
+	}
+	for _, tool := range tools {
+		schema := tool.InputSchema()
+		if schema == nil {
+			// Anthropic requires an input schema, even for tools without arguments
+			schema = map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			}
+		}
+		req.Tools = append(req.Tools, anthropicTool{
+			Name:        tool.Name(),
+			Description: tool.Description(),
+			InputSchema: schema,
+		})
+	}
+	return req
+}
+
+// Send a request to the Anthropic API, and decode the JSON response
+func anthropicRequestJSON(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	method, path string,
+	in, out interface{},
+) error {
+	httpRes, err := anthropicDo(ctx, baseURL, token, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+	data, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("anthropic: malformatted response: %w", err)
+	}
+	return nil
+}
+
+// Send a request to the Anthropic API, and check the response status.
+// The caller must close the response body.
+func anthropicDo(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	method, path string,
+	in interface{},
+) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	if baseURL == "" {
+		baseURL = anthropicBaseURL
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("anthropic-version", anthropicVersion)
+	if token != nil {
+		key, err := token.Plaintext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("x-api-key", key)
+	}
+	httpRes, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		defer httpRes.Body.Close()
+		data, _ := io.ReadAll(httpRes.Body)
+		var apiErr anthropicError
+		if err := json.Unmarshal(data, &apiErr); err == nil && apiErr.Error.Message != "" {
+			return nil, fmt.Errorf("anthropic: %s: %s", apiErr.Error.Type, apiErr.Error.Message)
+		}
+		return nil, fmt.Errorf("anthropic: unexpected status %s: %s", httpRes.Status, data)
+	}
+	return httpRes, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A tool echoing its input, failing when the input asks to
+type echoTool struct {
+	name  string
+	calls []string
+}
+
+func (t *echoTool) Name() string                        { return t.name }
+func (t *echoTool) Description() string                 { return "Echo the input" }
+func (t *echoTool) InputSchema() map[string]interface{} { return nil }
+func (t *echoTool) ReadOnly() bool                      { return false }
+
+func (t *echoTool) Call(ctx context.Context, input string) (string, error) {
+	t.calls = append(t.calls, input)
+	if strings.Contains(input, "fail") {
+		return "", toolErrorf("failed: %s", input)
+	}
+	return "echo " + input, nil
+}
+
+// A fake API server replying to each request in turn, and recording the requests
+type fakeAPI struct {
+	*httptest.Server
+	t        *testing.T
+	path     string
+	replies  []string
+	requests []map[string]interface{}
+	headers  []http.Header
+}
+
+func newFakeAPI(t *testing.T, path string, replies ...string) *fakeAPI {
+	api := &fakeAPI{t: t, path: path, replies: replies}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.serve))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != api.path {
+		http.NotFound(w, r)
+		return
+	}
+	if len(api.requests) == len(api.replies) {
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		api.t.Error(err)
+	}
+	var req map[string]interface{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		api.t.Errorf("malformatted request: %s", data)
+	}
+	reply := api.replies[len(api.requests)]
+	api.requests = append(api.requests, req)
+	api.headers = append(api.headers, r.Header)
+	if req["stream"] == true {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	io.WriteString(w, reply)
+}
+
+// Return a field of a decoded JSON value, following a path of keys and indexes
+func jsonPath(value interface{}, path ...interface{}) interface{} {
+	for _, key := range path {
+		switch key := key.(type) {
+		case string:
+			object, _ := value.(map[string]interface{})
+			value = object[key]
+		case int:
+			array, _ := value.([]interface{})
+			if key >= len(array) {
+				return nil
+			}
+			value = array[key]
+		}
+	}
+	return value
+}
+
+// Encode server-sent events, as in a streaming response
+func sseEvents(events ...string) string {
+	var sb strings.Builder
+	for _, event := range events {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(event), &typed)
+		fmt.Fprintf(&sb, "event: %s\ndata: %s\n\n", typed.Type, event)
+	}
+	return sb.String()
+}
+
+func TestAnthropicQuery(t *testing.T) {
+	api := newFakeAPI(t, "/v1/messages",
+		`{"id":"msg_1","role":"assistant","content":[
+			{"type":"text","text":"Let me check."},
+			{"type":"tool_use","id":"toolu_1","name":"echo","input":{"text":"hi"}},
+			{"type":"tool_use","id":"toolu_2","name":"echo","input":{}},
+			{"type":"tool_use","id":"toolu_3","name":"echo","input":{"text":"fail"}}
+		],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`,
+		`{"id":"msg_2","role":"assistant","content":[{"type":"text","text":"Done."}],"stop_reason":"end_turn","usage":{"input_tokens":20,"output_tokens":2}}`,
+	)
+	tool := &echoTool{name: "echo"}
+	st := Anthropic{}.New().WithSystemPrompt("Be brief").WithPrompt("Echo hi")
+	res, st, err := st.Query(context.Background(), "claude-test", api.URL, nil, []Tool{tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reply != "Let me check." || res.Usage.PromptTokens != 10 || res.Usage.CompletionTokens != 5 {
+		t.Fatalf("got %+v", res)
+	}
+	if strings.Join(tool.calls, " ") != `{"text":"hi"} {} {"text":"fail"}` {
+		t.Fatalf("got calls %q", tool.calls)
+	}
+	req := api.requests[0]
+	if req["model"] != "claude-test" || req["system"] != "Be brief" || req["stream"] != nil {
+		t.Fatalf("got request %v", req)
+	}
+	if api.headers[0].Get("anthropic-version") != anthropicVersion {
+		t.Fatalf("got headers %v", api.headers[0])
+	}
+	// The system prompt isn't a message
+	if messages := jsonPath(req, "messages").([]interface{}); len(messages) != 1 || jsonPath(messages, 0, "role") != "user" {
+		t.Fatalf("got messages %v", messages)
+	}
+	if jsonPath(req, "tools", 0, "name") != "echo" || jsonPath(req, "tools", 0, "input_schema", "type") != "object" {
+		t.Fatalf("got tools %v", req["tools"])
+	}
+
+	res, _, err = st.Query(context.Background(), "claude-test", api.URL, nil, []Tool{tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reply != "Done." {
+		t.Fatalf("got %+v", res)
+	}
+	// The tool calls are sent back, followed by their results in a single user message
+	messages := jsonPath(api.requests[1], "messages").([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("got messages %v", messages)
+	}
+	if input := jsonPath(messages, 1, "content", 2, "input"); input == nil {
+		t.Fatalf("expected the input of a call without arguments, got %v", messages[1])
+	}
+	for i, want := range []struct {
+		id      string
+		isError interface{}
+	}{{"toolu_1", nil}, {"toolu_2", nil}, {"toolu_3", true}} {
+		block := jsonPath(messages, 2, "content", i)
+		if jsonPath(block, "type") != "tool_result" || jsonPath(block, "tool_use_id") != want.id || jsonPath(block, "is_error") != want.isError {
+			t.Errorf("result %d: got %v", i, block)
+		}
+	}
+	if content := jsonPath(messages, 2, "content", 0, "content"); content != `echo {"text":"hi"}` {
+		t.Errorf("got %v", content)
+	}
+}
+
+func TestAnthropicQueryStream(t *testing.T) {
+	api := newFakeAPI(t, "/v1/messages",
+		sseEvents(
+			`{"type":"message_start","message":{"id":"msg_1","role":"assistant","content":[],"usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me "}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"check."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"echo","input":{}}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"text\":"}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"hi\"}"}}`,
+			`{"type":"content_block_stop","index":1}`,
+			// A call without arguments has no input deltas
+			`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_2","name":"echo","input":{}}}`,
+			`{"type":"content_block_stop","index":2}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":8}}`,
+			`{"type":"message_stop"}`,
+		),
+		sseEvents(
+			`{"type":"message_start","message":{"id":"msg_2","role":"assistant","content":[],"usage":{"input_tokens":20,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Done."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+			`{"type":"message_stop"}`,
+		),
+	)
+	tool := &echoTool{name: "echo"}
+	var deltas []string
+	onDelta := func(delta string) { deltas = append(deltas, delta) }
+	st := Anthropic{}.New().WithSystemPrompt("Be brief").WithPrompt("Echo hi")
+	res, st, err := st.QueryStream(context.Background(), "claude-test", api.URL, nil, []Tool{tool}, onDelta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reply != "Let me check." || strings.Join(deltas, "|") != "Let me |check." {
+		t.Fatalf("got %+v, deltas %q", res, deltas)
+	}
+	if res.Usage.PromptTokens != 10 || res.Usage.CompletionTokens != 8 {
+		t.Fatalf("got usage %+v", res.Usage)
+	}
+	if strings.Join(tool.calls, " ") != `{"text":"hi"} {}` {
+		t.Fatalf("got calls %q", tool.calls)
+	}
+	if api.requests[0]["stream"] != true || api.requests[0]["system"] != "Be brief" {
+		t.Fatalf("got request %v", api.requests[0])
+	}
+
+	if _, _, err := st.QueryStream(context.Background(), "claude-test", api.URL, nil, []Tool{tool}, onDelta); err != nil {
+		t.Fatal(err)
+	}
+	messages := jsonPath(api.requests[1], "messages").([]interface{})
+	if input, ok := jsonPath(messages, 1, "content", 2, "input").(map[string]interface{}); !ok || len(input) != 0 {
+		t.Fatalf("expected an empty input for a call without arguments, got %v", messages[1])
+	}
+	if jsonPath(messages, 1, "content", 1, "input", "text") != "hi" {
+		t.Fatalf("got %v", messages[1])
+	}
+	if jsonPath(messages, 2, "content", 1, "tool_use_id") != "toolu_2" {
+		t.Fatalf("got %v", messages[2])
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Which tool calls wait for approval before running
+const (
+	// None: scripts requiring approval by the sandbox policy are refused
+	ApprovalOff = "off"
+	// Scripts requiring approval by the sandbox policy
+	ApprovalPolicy = "policy"
+	// All calls to tools with side effects
+	ApprovalSideEffects = "side-effects"
+)
+
+// Action of the sandbox policy for scripts requiring approval
+const policyApprove = "approve"
+
+// Decisions on pending tool calls
+const (
+	ToolCallApproved = "approved"
+	ToolCallRejected = "rejected"
+)
+
+// Error returned when the loop can't go on until pending tool calls are decided
+var ErrApprovalPending = errors.New("tool calls awaiting approval")
+
+// A tool call awaiting approval
+type PendingToolCall struct {
+	// Position of the call in the model reply, to approve, edit or reject it
+	Index int
+	Name  string
+	// JSON-encoded arguments, as requested by the model or as edited
+	Arguments string
+	// Empty until decided: "approved" or "rejected"
+	Decision string
+	// For rejected calls: the reason given to the model
+	Feedback string
+}
+
+// Configure which tool calls wait for approval.
+// When a reply has calls to approve, Ask returns before running any of its calls:
+// list them with PendingToolCalls, decide each with ApproveToolCall, EditToolCall
+// or RejectToolCall, then resume with Continue.
+func (m Llm) WithApprovalMode(
+	// "off", "policy" for scripts requiring approval by the sandbox policy,
+	// or "side-effects" for all calls to tools with side effects
+	mode string,
+) (Llm, error) {
+	switch mode {
+	case ApprovalOff, ApprovalPolicy, ApprovalSideEffects:
+	default:
+		return m, fmt.Errorf("unknown approval mode: %q", mode)
+	}
+	m.ApprovalMode = mode
+	return m, nil
+}
+
+// The tool calls awaiting approval
+func (m Llm) PendingToolCalls() []PendingToolCall {
+	return m.Pending
+}
+
+// Approve a pending tool call
+func (m Llm) ApproveToolCall(
+	// Position of the call in the model reply
+	index int,
+) (Llm, error) {
+	return m.decide(index, func(call *PendingToolCall) (string, error) {
+		call.Decision = ToolCallApproved
+		return fmt.Sprintf("✅ %s %s", call.Name, call.Arguments), nil
+	})
+}
+
+// Approve a pending tool call, with different arguments.
+// The model sees the call as if it had requested these arguments.
+func (m Llm) EditToolCall(
+	ctx context.Context,
+	// Position of the call in the model reply
+	index int,
+	// JSON-encoded arguments, matching the input schema of the tool
+	arguments string,
+) (Llm, error) {
+	var schema map[string]interface{}
+	ts, err := m.toolServer(ctx)
+	if err != nil {
+		return m, err
+	}
+	for _, tool := range ts.Tools() {
+		for _, call := range m.Pending {
+			if call.Index == index && call.Name == tool.Name() {
+				// Round-trip the schema through JSON, to validate against its decoded form
+				data, err := json.Marshal(tool.InputSchema())
+				if err != nil {
+					return m, err
+				}
+				if err := json.Unmarshal(data, &schema); err != nil {
+					return m, err
+				}
+			}
+		}
+	}
+	return m.decide(index, func(call *PendingToolCall) (string, error) {
+		if err := validateJSON(schema, arguments); err != nil {
+			return "", fmt.Errorf("tool call %d: %w", index, err)
+		}
+		call.Decision = ToolCallApproved
+		call.Arguments = arguments
+		return fmt.Sprintf("✏️ %s %s", call.Name, call.Arguments), nil
+	})
+}
+
+// Reject a pending tool call. The model is told the call was rejected, with the feedback.
+func (m Llm) RejectToolCall(
+	// Position of the call in the model reply
+	index int,
+	// Why the call is rejected, or what to do instead
+	// +optional
+	feedback string,
+) (Llm, error) {
+	return m.decide(index, func(call *PendingToolCall) (string, error) {
+		call.Decision = ToolCallRejected
+		call.Feedback = feedback
+		if feedback == "" {
+			return fmt.Sprintf("❌ %s", call.Name), nil
+		}
+		return fmt.Sprintf("❌ %s: %s", call.Name, feedback), nil
+	})
+}
+
+// Update a pending tool call, and log the decision
+func (m Llm) decide(index int, update func(*PendingToolCall) (string, error)) (Llm, error) {
+	// Copy the list, so that Llm values derived from each other don't share it
+	pending := append([]PendingToolCall(nil), m.Pending...)
+	for i := range pending {
+		if pending[i].Index != index {
+			continue
+		}
+		note, err := update(&pending[i])
+		if err != nil {
+			return m, err
+		}
+		m.Pending = pending
+		return m.withNote(note, "🧑"), nil
+	}
+	return m, fmt.Errorf("no pending tool call at index %d", index)
+}
+
+// Tools whose calls may wait for approval
+type approvalGate interface {
+	needsApproval(ctx context.Context, input string) bool
+}
+
+// Return true if a tool call must wait for approval.
+// Script is the sandbox script the call runs, if any.
+func (ts *toolServer) needsApproval(ctx context.Context, readOnly bool, script string) bool {
+	if isApproved(ctx) {
+		return false
+	}
+	switch ts.approvalMode {
+	case ApprovalSideEffects:
+		return !readOnly
+	case ApprovalPolicy:
+		if script == "" {
+			return false
+		}
+		// If the policy can't be checked, the sandbox stops the script when it runs
+		action, err := ts.sandbox.CheckPolicy(script).Action(ctx)
+		return err == nil && action == policyApprove
+	}
+	return false
+}
+
+type approvedKey struct{}
+
+// Mark tool calls made with the context as approved: they don't wait for approval,
+// and the sandbox policy lets their scripts run even if they require approval
+func withApproval(ctx context.Context) context.Context {
+	return context.WithValue(ctx, approvedKey{}, true)
+}
+
+func isApproved(ctx context.Context) bool {
+	approved, _ := ctx.Value(approvedKey{}).(bool)
+	return approved
+}
+
+// Record the calls of the last reply awaiting approval, and save the state
+func (m Llm) awaitApproval(ctx context.Context, st LlmState, tools []Tool) (Llm, error) {
+	m.Pending = nil
+	history, err := st.History()
+	if err != nil {
+		return m, err
+	}
+	for i, call := range lastToolCalls(history) {
+		for _, tool := range tools {
+			gate, ok := tool.(approvalGate)
+			if tool.Name() == call.Name && ok && gate.needsApproval(ctx, call.Arguments) {
+				m.Pending = append(m.Pending, PendingToolCall{
+					Index:     i,
+					Name:      call.Name,
+					Arguments: call.Arguments,
+				})
+				m = m.withNote(fmt.Sprintf("%s %s", call.Name, call.Arguments), "⏸️")
+			}
+		}
+	}
+	return m.withLlmState(st)
+}
+
+// Run the calls of the last reply, now that pending calls are decided
+func (m Llm) resumeToolCalls(ctx context.Context, st LlmState) (Llm, LlmState, error) {
+	var undecided int
+	for _, call := range m.Pending {
+		if call.Decision == "" {
+			undecided++
+		}
+	}
+	if undecided > 0 {
+		return m, st, fmt.Errorf("%w: %d undecided", ErrApprovalPending, undecided)
+	}
+	history, err := st.History()
+	if err != nil {
+		return m, st, err
+	}
+	calls := lastToolCalls(history)
+	if len(calls) == 0 {
+		return m, st, fmt.Errorf("no tool calls to resume")
+	}
+	calls = append([]ToolCall(nil), calls...)
+	outputs := make([]toolResult, len(calls))
+	var (
+		run   []ToolCall
+		runAt []int
+	)
+	for i := range calls {
+		var (
+			rejected bool
+			feedback string
+		)
+		for _, pending := range m.Pending {
+			if pending.Index == i {
+				calls[i].Arguments = pending.Arguments
+				rejected = pending.Decision == ToolCallRejected
+				feedback = pending.Feedback
+			}
+		}
+		if rejected {
+			out, err := rejectedResult(feedback)
+			if err != nil {
+				return m, st, err
+			}
+			outputs[i] = toolResult{Output: out, IsError: true}
+			continue
+		}
+		run = append(run, calls[i])
+		runAt = append(runAt, i)
+	}
+	ts, err := m.toolServer(ctx)
+	if err != nil {
+		return m, st, err
+	}
+	results, err := callTools(withApproval(ctx), run, ts.Tools())
+	m.Sandbox = ts.flush()
+	if err != nil {
+		return m, st, err
+	}
+	for j, i := range runAt {
+		outputs[i] = results[j]
+	}
+	// The model sees edited calls as if it had requested them
+	history[len(history)-1].ToolCalls = calls
+	for i, call := range calls {
+		history = append(history, Message{
+			Role:       "tool",
+			Content:    textContent(outputs[i].Output),
+			ToolCallID: call.ID,
+			IsError:    outputs[i].IsError,
+		})
+	}
+	m.ToolCalls += ts.Count()
+	m = m.withToolCalls(ts.calls)
+	m.Pending = nil
+	return m, st.WithHistory(history), nil
+}
+
+// Return the tool calls of the last message, if it is a reply awaiting tool results
+func lastToolCalls(history []Message) []ToolCall {
+	if len(history) == 0 || history[len(history)-1].Role != "assistant" {
+		return nil
+	}
+	return history[len(history)-1].ToolCalls
+}
+
+// Return a rejection as a tool result, shaped like run results
+func rejectedResult(feedback string) (string, error) {
+	res := struct {
+		Output  string `json:"output"`
+		Error   string `json:"error"`
+		Success bool   `json:"success"`
+		Status  string `json:"status"`
+	}{
+		Error:  "the user rejected the call",
+		Status: ToolCallRejected,
+	}
+	if feedback != "" {
+		res.Error += ": " + feedback
+	}
+	b, err := json.Marshal(res)
+	return string(b), err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Strategies to compact old turns of the history
+const (
+	// Never compact old turns
+	CompactionNone = "none"
+	// Drop old turns
+	CompactionDrop = "drop"
+	// Replace old turns with a summary written by the model
+	CompactionSummarize = "summarize"
+)
+
+const (
+	summaryPrefix = "Summary of the earlier conversation:\n"
+	summaryPrompt = `You summarize conversations between a user and an AI assistant using tools.
+Write a concise summary of the conversation you are given, so that the assistant can continue the task without it.
+Keep the user's requests, the decisions made, important facts learned from tool outputs, and the work left to do.`
+)
+
+// How the history is kept within the model's context window
+type Compaction struct {
+	// How to compact old turns: "none", "drop" or "summarize"
+	Strategy string
+	// Estimated history size, in tokens, above which old turns are compacted. Zero means no limit.
+	MaxTokens int
+	// Maximum size of a single tool output, in bytes. Larger outputs keep their head and tail.
+	// Zero means no limit.
+	MaxToolOutput int
+	// Number of most recent turns compacted step by step, rather than whole.
+	// Their prompts, and the latest step, are never compacted.
+	KeepTurns int
+}
+
+func defaultCompaction() Compaction {
+	return Compaction{
+		Strategy:      CompactionDrop,
+		MaxTokens:     100000,
+		MaxToolOutput: 20000,
+		KeepTurns:     2,
+	}
+}
+
+func (c Compaction) validate() error {
+	switch c.Strategy {
+	case CompactionNone, CompactionDrop, CompactionSummarize:
+		return nil
+	}
+	return fmt.Errorf("unknown compaction strategy: %q", c.Strategy)
+}
+
+// Truncate tool outputs larger than the maximum.
+// Return true if any output was truncated.
+func (c Compaction) truncateToolOutputs(messages []Message) ([]Message, bool) {
+	if c.MaxToolOutput <= 0 {
+		return messages, false
+	}
+	var truncated bool
+	out := make([]Message, len(messages))
+	for i, msg := range messages {
+		if text := msg.Text(); msg.Role == "tool" && len(text) > c.MaxToolOutput {
+			msg.Content = textContent(elide(text, c.MaxToolOutput))
+			truncated = true
+		}
+		out[i] = msg
+	}
+	return out, truncated
+}
+
+// Shorten a text to at most max bytes, keeping its head and tail
+func elide(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	// Leave room for the marker, so that elided text is never elided again.
+	// The marker is longest when the whole text is elided.
+	room := len(elisionMarker(len(text)))
+	if max < room {
+		// No room for a marker: keep the head
+		end := max
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		return text[:end]
+	}
+	keep := max - room
+	head := keep / 2
+	for head > 0 && !utf8.RuneStart(text[head]) {
+		head--
+	}
+	tail := len(text) - (keep - head)
+	for tail < len(text) && !utf8.RuneStart(text[tail]) {
+		tail++
+	}
+	return text[:head] + elisionMarker(tail-head) + text[tail:]
+}
+
+func elisionMarker(elided int) string {
+	return fmt.Sprintf("\n[... %d bytes elided ...]\n", elided)
+}
+
+// Rough number of tokens taken by an image, whatever its size
+const estimatedImageTokens = 1000
+
+// Estimate the number of tokens in a message history, at about 4 bytes per token
+func estimateTokens(messages []Message) int {
+	var size int
+	for _, msg := range messages {
+		for _, part := range msg.Content {
+			size += len(part.Text)
+			if part.Type == "image" {
+				size += estimatedImageTokens * 4
+			}
+		}
+		for _, call := range msg.ToolCalls {
+			size += len(call.Name) + len(call.Arguments)
+		}
+	}
+	return size / 4
+}
+
+// Split a message history into system messages, and turns.
+// Each turn starts with a user message.
+func splitTurns(messages []Message) (system []Message, turns [][]Message) {
+	for _, msg := range messages {
+		switch {
+		case msg.Role == "system":
+			system = append(system, msg)
+		case msg.Role == "user" || len(turns) == 0:
+			turns = append(turns, []Message{msg})
+		default:
+			turns[len(turns)-1] = append(turns[len(turns)-1], msg)
+		}
+	}
+	return system, turns
+}
+
+// Split a turn into its prompt, and steps.
+// Each step starts with an assistant message, and holds the results of its tool calls.
+func splitSteps(turn []Message) (prompt []Message, steps [][]Message) {
+	for _, msg := range turn {
+		switch {
+		case msg.Role == "assistant":
+			steps = append(steps, []Message{msg})
+		case len(steps) == 0:
+			prompt = append(prompt, msg)
+		default:
+			steps[len(steps)-1] = append(steps[len(steps)-1], msg)
+		}
+	}
+	return prompt, steps
+}
+
+// A part of the history compacted as a whole
+type segment struct {
+	messages []Message
+	// A whole turn, rather than a step
+	turn bool
+	// Never compacted
+	keep bool
+}
+
+// Split turns into the segments to compact, in order.
+// Old turns are compacted whole. The most recent turns are split into steps,
+// so that a long turn can be compacted too: their prompts, and the latest step, are kept.
+func (c Compaction) segments(turns [][]Message) []segment {
+	keepTurns := c.KeepTurns
+	if keepTurns < 1 {
+		keepTurns = 1
+	}
+	var segments []segment
+	for i, turn := range turns {
+		if i < len(turns)-keepTurns {
+			segments = append(segments, segment{messages: turn, turn: true})
+			continue
+		}
+		prompt, steps := splitSteps(turn)
+		if len(prompt) > 0 {
+			segments = append(segments, segment{messages: prompt, keep: true})
+		}
+		for j, step := range steps {
+			last := i == len(turns)-1 && j == len(steps)-1
+			segments = append(segments, segment{messages: step, keep: last})
+		}
+	}
+	return segments
+}
+
+// Describe the number of compacted turns and steps
+func describeCompacted(turns, steps int) string {
+	var parts []string
+	if turns > 0 {
+		parts = append(parts, fmt.Sprintf("%d old turns", turns))
+	}
+	if steps > 0 {
+		parts = append(parts, fmt.Sprintf("%d old steps", steps))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Format messages as a plain text transcript
+func transcript(messages []Message) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		switch msg.Role {
+		case "tool":
+			fmt.Fprintf(&b, "[tool result]\n%s\n\n", msg.Text())
+		default:
+			if text := msg.Text(); text != "" {
+				fmt.Fprintf(&b, "[%s]\n%s\n\n", msg.Role, text)
+			}
+			for _, call := range msg.ToolCalls {
+				fmt.Fprintf(&b, "[%s calls tool %s]\n%s\n\n", msg.Role, call.Name, call.Arguments)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Compact the history of the state, and note in the sandbox history what was compacted
+func (m Llm) compact(ctx context.Context, st LlmState) (Llm, LlmState, error) {
+	m, st, note, err := m.compactHistory(ctx, st)
+	if err == nil && note != "" {
+		m = m.withNote(note, "🗜️")
+	}
+	return m, st, err
+}
+
+// Compact the history of the state according to the configured strategy,
+// and return a note of what was compacted, or an empty note if nothing was.
+// Tool outputs are truncated first. Then, if the history is still too large,
+// old turns are dropped or summarized, then old steps of the recent turns.
+// System messages are always kept.
+func (m Llm) compactHistory(ctx context.Context, st LlmState) (Llm, LlmState, string, error) {
+	c := m.Compaction
+	history, err := st.History()
+	if err != nil {
+		return m, st, "", err
+	}
+	messages, truncated := c.truncateToolOutputs(history)
+	if truncated {
+		st = st.WithHistory(messages)
+	}
+	if c.Strategy == CompactionNone || c.MaxTokens <= 0 || estimateTokens(messages) <= c.MaxTokens {
+		return m, st, "", nil
+	}
+	system, turns := splitTurns(messages)
+	var previousSummary string
+	if c.Strategy == CompactionSummarize {
+		// Fold the previous summary into the next one.
+		// Some providers merge system messages, so the summary may follow the system prompt.
+		for i, msg := range system {
+			before, summary, found := strings.Cut(msg.Text(), summaryPrefix)
+			if !found {
+				continue
+			}
+			previousSummary = summary
+			if before = strings.TrimSpace(before); before == "" {
+				system = append(system[:i:i], system[i+1:]...)
+			} else {
+				system[i].Content = textContent(before)
+			}
+			break
+		}
+	}
+	// Compact the oldest segments, until the rest fits
+	segments := c.segments(turns)
+	size := estimateTokens(system)
+	for _, seg := range segments {
+		size += estimateTokens(seg.messages)
+	}
+	var (
+		old, kept          []Message
+		oldTurns, oldSteps int
+	)
+	for _, seg := range segments {
+		if seg.keep || size <= c.MaxTokens {
+			kept = append(kept, seg.messages...)
+			continue
+		}
+		size -= estimateTokens(seg.messages)
+		old = append(old, seg.messages...)
+		if seg.turn {
+			oldTurns++
+		} else {
+			oldSteps++
+		}
+	}
+	if len(old) == 0 {
+		return m, st, "", nil
+	}
+	compacted := describeCompacted(oldTurns, oldSteps)
+	var note string
+	switch c.Strategy {
+	case CompactionDrop:
+		note = fmt.Sprintf("dropped %s from the history", compacted)
+	case CompactionSummarize:
+		text := transcript(old)
+		if previousSummary != "" {
+			text = summaryPrefix + previousSummary + "\n\n" + text
+		}
+		res, err := m.summarize(ctx, text)
+		if err != nil {
+			return m, st, "", fmt.Errorf("summarize history: %w", err)
+		}
+		m.TokenUsage = m.TokenUsage.add(res.Usage)
+		system = append(system, Message{
+			Role:    "system",
+			Content: textContent(summaryPrefix + res.Reply),
+		})
+		note = fmt.Sprintf("summarized %s of the history", compacted)
+	}
+	return m, st.WithHistory(append(system, kept...)), note, nil
+}
+
+// Ask the model to summarize a transcript, in a separate session
+func (m Llm) summarize(ctx context.Context, text string) (QueryResult, error) {
+	provider, model, err := m.llmProvider()
+	if err != nil {
+		return QueryResult{}, err
+	}
+	baseURL, err := endpointURL(ctx, m.Endpoint, "")
+	if err != nil {
+		return QueryResult{}, err
+	}
+	st := provider.New().WithSystemPrompt(summaryPrompt).WithPrompt(text)
+	res, _, err := st.Query(ctx, model, baseURL, m.Token, nil)
+	return res, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A single long turn is compacted step by step, keeping each tool call with its result
+func TestCompactSingleTurn(t *testing.T) {
+	for _, provider := range []LlmProvider{OpenAI{}, Anthropic{}, Ollama{}} {
+		t.Run(provider.Name(), func(t *testing.T) {
+			history := []Message{
+				{Role: "system", Content: textContent("sys")},
+				{Role: "user", Content: textContent("Do the task")},
+			}
+			for i := 0; i < 10; i++ {
+				history = append(history,
+					Message{Role: "assistant", ToolCalls: []ToolCall{
+						{ID: fmt.Sprintf("call_%d", i), Name: "dagger", Arguments: `{"command":"ls"}`},
+					}},
+					Message{Role: "tool", ToolCallID: fmt.Sprintf("call_%d", i), Content: textContent(fmt.Sprintf("step %d\n%s", i, strings.Repeat("x", 4000)))},
+				)
+			}
+			st := provider.New().WithHistory(history)
+			m := Llm{Compaction: Compaction{Strategy: CompactionDrop, MaxTokens: 3000, KeepTurns: 2}}
+			_, st, note, err := m.compactHistory(context.Background(), st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compacted, err := st.History()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if estimateTokens(compacted) > 3000 {
+				t.Fatalf("history still too large: %d tokens", estimateTokens(compacted))
+			}
+			if len(compacted) < 4 || compacted[0].Text() != "sys" || compacted[1].Text() != "Do the task" {
+				t.Fatalf("expected the system prompt and the prompt to be kept, got %+v", compacted)
+			}
+			// Steps are kept whole: each tool call is followed by its result.
+			// Ollama doesn't keep call IDs.
+			if len(compacted)%2 != 0 {
+				t.Fatalf("expected pairs of tool calls and results, got %d messages", len(compacted))
+			}
+			for i := 2; i < len(compacted); i += 2 {
+				call, result := compacted[i], compacted[i+1]
+				if call.Role != "assistant" || result.Role != "tool" || result.ToolCallID != call.ToolCalls[0].ID {
+					t.Fatalf("unpaired tool call at %d: %s, %s", i, call.Role, result.Role)
+				}
+			}
+			if last := compacted[len(compacted)-1].Text(); !strings.HasPrefix(last, "step 9\n") {
+				t.Fatalf("expected the latest step to be kept, got %.10q", last)
+			}
+			if !strings.Contains(note, "old steps") {
+				t.Fatalf("got %q", note)
+			}
+		})
+	}
+}
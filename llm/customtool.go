@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"dagger/llm/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Tool names accepted by all providers
+var toolNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// A tool registered on Llm, offered to the model alongside the builtin tools.
+// Exactly one of Function, Container and Service is set.
+type CustomTool struct {
+	Name        string
+	Description string
+	// JSON schema of the tool input
+	InputSchema string
+	// Calls have no side effects, and can run concurrently
+	ReadOnly bool
+	// A dagger shell command, called in the sandbox with the input as flags
+	Function string
+	// A container executing Args, with the input on stdin
+	Container *dagger.Container
+	Args      []string
+	// An HTTP service, sent the input as request body, or as query parameters for GET and HEAD
+	Service *dagger.Service
+	Method  string
+	Path    string
+}
+
+// Offer the model a Dagger function as a tool.
+// Calls run in the sandbox like dagger shell commands, with the properties of the
+// input appended as flags: {"name": "foo"} runs "<function> --name foo".
+func (m Llm) WithFunctionTool(
+	ctx context.Context,
+	// Tool name, made of letters, digits, "_" and "-"
+	name string,
+	// What the tool does, for the model
+	description string,
+	// A dagger shell command, eg. "github.com/dagger/dagger/modules/go $(host | directory .) | test"
+	function string,
+	// JSON schema of the tool input: an object with a property per function argument
+	// +optional
+	inputSchema string,
+) (Llm, error) {
+	return m.withCustomTool(ctx, CustomTool{
+		Name:        name,
+		Description: description,
+		InputSchema: inputSchema,
+		Function:    function,
+	})
+}
+
+// Offer the model a container command as a tool.
+// Calls execute the command with the input JSON on stdin, and return its output.
+func (m Llm) WithContainerTool(
+	ctx context.Context,
+	// Tool name, made of letters, digits, "_" and "-"
+	name string,
+	// What the tool does, for the model
+	description string,
+	// The container to execute the command in
+	container *dagger.Container,
+	// The command to execute
+	args []string,
+	// JSON schema of the tool input
+	// +optional
+	inputSchema string,
+	// Calls have no side effects, and can run concurrently
+	// +optional
+	readOnly bool,
+) (Llm, error) {
+	if len(args) == 0 {
+		return m, fmt.Errorf("tool %s: no command", name)
+	}
+	return m.withCustomTool(ctx, CustomTool{
+		Name:        name,
+		Description: description,
+		InputSchema: inputSchema,
+		ReadOnly:    readOnly,
+		Container:   container,
+		Args:        args,
+	})
+}
+
+// Offer the model an HTTP endpoint of a service as a tool.
+// Calls send the input JSON as request body, and return the response body.
+// GET and HEAD requests have no body: they send the input properties as query parameters,
+// like flags of function tools.
+func (m Llm) WithServiceTool(
+	ctx context.Context,
+	// Tool name, made of letters, digits, "_" and "-"
+	name string,
+	// What the tool does, for the model
+	description string,
+	// The service to send requests to
+	service *dagger.Service,
+	// Path of the endpoint
+	// +optional
+	// +default="/"
+	path string,
+	// HTTP method. GET and HEAD requests send the input as query parameters.
+	// +optional
+	// +default="POST"
+	method string,
+	// JSON schema of the tool input
+	// +optional
+	inputSchema string,
+	// Calls have no side effects, and can run concurrently
+	// +optional
+	readOnly bool,
+) (Llm, error) {
+	return m.withCustomTool(ctx, CustomTool{
+		Name:        name,
+		Description: description,
+		InputSchema: inputSchema,
+		ReadOnly:    readOnly,
+		Service:     service,
+		Method:      strings.ToUpper(method),
+		Path:        path,
+	})
+}
+
+func (m Llm) withCustomTool(ctx context.Context, tool CustomTool) (Llm, error) {
+	if !toolNameRE.MatchString(tool.Name) {
+		return m, fmt.Errorf("invalid tool name %q: use up to 64 letters, digits, \"_\" and \"-\"", tool.Name)
+	}
+	ts, err := m.toolServer(ctx)
+	if err != nil {
+		return m, err
+	}
+	for _, existing := range ts.Tools() {
+		if existing.Name() == tool.Name {
+			return m, fmt.Errorf("tool already exists: %s", tool.Name)
+		}
+	}
+	if tool.InputSchema == "" {
+		tool.InputSchema = `{"type":"object","properties":{}}`
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(tool.InputSchema), &schema); err != nil {
+		return m, fmt.Errorf("tool %s: malformatted input schema: %w", tool.Name, err)
+	}
+	if schema["type"] != "object" {
+		return m, fmt.Errorf("tool %s: input schema must describe an object", tool.Name)
+	}
+	// Copy the list, so that Llm values derived from each other don't share it
+	m.CustomTools = append(m.CustomTools[:len(m.CustomTools):len(m.CustomTools)], tool)
+	return m, nil
+}
+
+type customTool struct {
+	*toolServer
+	spec CustomTool
+}
+
+func (t customTool) Name() string {
+	return t.spec.Name
+}
+
+func (t customTool) Description() string {
+	return t.spec.Description
+}
+
+func (t customTool) InputSchema() map[string]interface{} {
+	var schema map[string]interface{}
+	// The schema was validated when the tool was registered
+	json.Unmarshal([]byte(t.spec.InputSchema), &schema)
+	return schema
+}
+
+// Functions run in the sandbox, so they are never read-only
+func (t customTool) ReadOnly() bool {
+	return t.spec.ReadOnly && t.spec.Function == ""
+}
+
+func (t customTool) needsApproval(ctx context.Context, input string) bool {
+	var script string
+	if t.spec.Function != "" {
+		if flags, err := functionFlags(input); err == nil {
+			script = t.spec.Function + flags
+		}
+	}
+	return t.toolServer.needsApproval(ctx, t.ReadOnly(), script)
+}
+
+func (t customTool) Call(ctx context.Context, input string) (string, error) {
+	output, _, err := t.callRun(ctx, input)
+	return output, err
+}
+
+// Call the tool. Container and service calls are reported as runs, to log in the history.
+// Function calls run in the sandbox, which logs them.
+func (t customTool) callRun(ctx context.Context, input string) (string, *toolRun, error) {
+	var call func(ctx context.Context, input string) (stdout, stderr string, exitCode int, err error)
+	switch {
+	case t.spec.Function != "":
+		output, err := t.callFunction(ctx, input)
+		return output, nil, err
+	case t.spec.Container != nil:
+		call = t.callContainer
+	case t.spec.Service != nil:
+		call = t.callService
+	default:
+		return "", nil, fmt.Errorf("tool %s: nothing to call", t.spec.Name)
+	}
+	run, err := t.run(ctx, input, call)
+	if err != nil {
+		return "", nil, err
+	}
+	// Report the result like a sandbox run, so that the model reads all of them the same way.
+	// The sandbox caps the output like the output of its runs.
+	output, err := run.log(t.sandbox).Result(ctx)
+	return output, &run, err
+}
+
+func (t customTool) callFunction(ctx context.Context, input string) (string, error) {
+	flags, err := functionFlags(input)
+	if err != nil {
+		return "", err
+	}
+	t.sandbox = t.flush().Run(t.spec.Function+flags, dagger.SandboxRunOpts{Approved: isApproved(ctx)})
+	return t.sandbox.Result(ctx)
+}
+
+// Convert a JSON object to dagger shell flags
+func functionFlags(input string) (string, error) {
+	args, err := inputArgs(input)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var flags strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&flags, " --%s %s", name, shellQuote(args[name]))
+	}
+	return flags.String(), nil
+}
+
+// Convert a JSON object to string arguments. Non-string values are passed as JSON.
+func inputArgs(input string) (map[string]string, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(input), &object); err != nil {
+		return nil, toolErrorf("malformatted input: %w", err)
+	}
+	args := make(map[string]string, len(object))
+	for name, value := range object {
+		if s, ok := value.(string); ok {
+			args[name] = s
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = string(data)
+	}
+	return args, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (t customTool) callContainer(ctx context.Context, input string) (string, string, int, error) {
+	ctr := t.spec.Container.WithExec(t.spec.Args, dagger.ContainerWithExecOpts{
+		Stdin:  input,
+		Expect: dagger.ReturnTypeAny,
+	})
+	stdout, err := ctr.Stdout(ctx)
+	if err != nil {
+		return "", "", 0, err
+	}
+	stderr, err := ctr.Stderr(ctx)
+	if err != nil {
+		return "", "", 0, err
+	}
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return stdout, stderr, exitCode, nil
+}
+
+func (t customTool) callService(ctx context.Context, input string) (string, string, int, error) {
+	baseURL, err := endpointURL(ctx, t.spec.Service, "")
+	if err != nil {
+		return "", "", 0, err
+	}
+	reqURL, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(t.spec.Path, "/"))
+	if err != nil {
+		return "", "", 0, err
+	}
+	var body io.Reader
+	if t.spec.Method == http.MethodGet || t.spec.Method == http.MethodHead {
+		args, err := inputArgs(input)
+		if err != nil {
+			return "", "", 0, err
+		}
+		query := reqURL.Query()
+		for name, value := range args {
+			query.Set(name, value)
+		}
+		reqURL.RawQuery = query.Encode()
+	} else {
+		body = strings.NewReader(input)
+	}
+	req, err := http.NewRequestWithContext(ctx, t.spec.Method, reqURL.String(), body)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", "", 0, err
+	}
+	// Failed requests are runs failing with the HTTP status as error
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return string(data), res.Status, 1, nil
+	}
+	return string(data), "", 0, nil
+}
+
+// Call a container or a service within the sandbox timeout, and return the call as a run.
+// Calls interrupted by the timeout are timed out runs: other errors fail the call.
+func (t customTool) run(
+	ctx context.Context,
+	input string,
+	call func(ctx context.Context, input string) (stdout, stderr string, exitCode int, err error),
+) (_ toolRun, rerr error) {
+	ctx, span := Tracer().Start(ctx, fmt.Sprintf("[%s] 🔧 %s %s", t.username, t.spec.Name, input))
+	defer func() {
+		if rerr != nil {
+			span.SetStatus(codes.Error, rerr.Error())
+		}
+		span.End()
+	}()
+	run := toolRun{Tool: t.spec.Name, Input: input, Started: time.Now()}
+	callCtx, cancel := t.withTimeout(ctx)
+	defer cancel()
+	var err error
+	run.Stdout, run.Stderr, run.ExitCode, err = call(callCtx, input)
+	run.Duration = time.Since(run.Started)
+	if err != nil {
+		if !errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+			return run, err
+		}
+		run.Stdout, run.Stderr = "", fmt.Sprintf("%s: timed out after %ds", t.spec.Name, t.timeout)
+		run.TimedOut = true
+	}
+	if run.ExitCode != 0 || run.TimedOut {
+		span.SetStatus(codes.Error, run.Stderr)
+	}
+	return run, nil
+}
+
+// Apply the sandbox timeout to a call
+func (t customTool) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(t.timeout)*time.Second)
+}
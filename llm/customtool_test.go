@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Container and service calls are reported as sandbox runs, timing out after the sandbox timeout
+func TestCustomToolRun(t *testing.T) {
+	tool := customTool{
+		toolServer: &toolServer{username: "agent", timeout: 1},
+		spec:       CustomTool{Name: "lint"},
+	}
+	run, err := tool.run(context.Background(), `{"path":"."}`, func(ctx context.Context, input string) (string, string, int, error) {
+		return "out", "500 Internal Server Error", 1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Tool != "lint" || run.Input != `{"path":"."}` || run.Stdout != "out" || run.Stderr != "500 Internal Server Error" || run.ExitCode != 1 || run.TimedOut {
+		t.Fatalf("got %+v", run)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	run, err = tool.run(ctx, "{}", func(ctx context.Context, input string) (string, string, int, error) {
+		<-ctx.Done()
+		return "partial", "", 0, ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !run.TimedOut || run.Stdout != "" || !strings.Contains(run.Stderr, "timed out after 1s") {
+		t.Fatalf("got %+v", run)
+	}
+	// Other errors fail the call
+	failure := errors.New("connection refused")
+	_, err = tool.run(context.Background(), "{}", func(ctx context.Context, input string) (string, string, int, error) {
+		return "", "", 0, failure
+	})
+	if err != failure {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestInputArgs(t *testing.T) {
+	flags, err := functionFlags(`{"name":"it's","n":3,"tags":["a"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != ` --n '3' --name 'it'\''s' --tags '["a"]'` {
+		t.Fatalf("got %q", flags)
+	}
+	var toolErr toolError
+	if _, err := inputArgs(`{"name":`); !errors.As(err, &toolErr) {
+		t.Fatalf("expected a tool error, got %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"dagger/llm/internal/dagger"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// How manuals are offered to the model
+const (
+	// One tool per manual, without arguments
+	KnowledgeTools = "tools"
+	// A tool to search all manuals, and a tool to read a manual or one of its sections
+	KnowledgeSearch = "search"
+)
+
+const (
+	// Manuals larger than this are read one section at a time
+	maxManualRead = 8000
+	// Number of results returned by a search
+	maxSearchResults = 10
+	// Size of the excerpt shown with each search result
+	snippetSize = 200
+)
+
+var headingRE = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+
+// An instruction manual of the sandbox
+type Manual struct {
+	Name        string
+	Description string
+	Contents    string
+}
+
+// Read the manuals of a sandbox
+func loadManuals(ctx context.Context, sandbox *dagger.Sandbox) ([]Manual, error) {
+	found, err := sandbox.Manuals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manuals := make([]Manual, len(found))
+	for i, man := range found {
+		if manuals[i].Name, err = man.Name(ctx); err != nil {
+			return nil, err
+		}
+		if manuals[i].Description, err = man.Description(ctx); err != nil {
+			return nil, err
+		}
+		if manuals[i].Contents, err = man.Contents(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return manuals, nil
+}
+
+// A section of a manual, from a markdown heading to the next one
+type manualSection struct {
+	Manual  string
+	Heading string
+	Text    string
+}
+
+// Split a manual into sections, by markdown heading.
+// Text before the first heading is a section without heading.
+// Headings inside fenced code blocks are ignored.
+func splitSections(man Manual) []manualSection {
+	var (
+		sections []manualSection
+		current  = manualSection{Manual: man.Name}
+		text     strings.Builder
+		fenced   bool
+	)
+	flush := func() {
+		current.Text = strings.TrimSpace(text.String())
+		if current.Text != "" {
+			sections = append(sections, current)
+		}
+		text.Reset()
+	}
+	for _, line := range strings.Split(man.Contents, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fenced = !fenced
+		}
+		if match := headingRE.FindStringSubmatch(line); match != nil && !fenced {
+			flush()
+			current = manualSection{Manual: man.Name, Heading: match[1]}
+		}
+		text.WriteString(line)
+		text.WriteString("\n")
+	}
+	flush()
+	return sections
+}
+
+// A full-text index of manual sections, ranked with BM25
+type manualIndex struct {
+	sections []manualSection
+	// For each term, the number of occurrences in each section containing it
+	postings  map[string]map[int]int
+	lengths   []int
+	avgLength float64
+}
+
+func newManualIndex(manuals []Manual) *manualIndex {
+	idx := &manualIndex{postings: map[string]map[int]int{}}
+	var total int
+	for _, man := range manuals {
+		for _, section := range splitSections(man) {
+			doc := len(idx.sections)
+			idx.sections = append(idx.sections, section)
+			// The description and heading are searchable along with the text
+			terms := tokenize(man.Name + " " + man.Description + " " + section.Heading + " " + section.Text)
+			for _, term := range terms {
+				if idx.postings[term] == nil {
+					idx.postings[term] = map[int]int{}
+				}
+				idx.postings[term][doc]++
+			}
+			idx.lengths = append(idx.lengths, len(terms))
+			total += len(terms)
+		}
+	}
+	if len(idx.sections) > 0 {
+		idx.avgLength = float64(total) / float64(len(idx.sections))
+	}
+	return idx
+}
+
+// Split a text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type searchResult struct {
+	// Key of the manual, to read it with read_manual
+	Key     string  `json:"key"`
+	Section string  `json:"section,omitempty"`
+	Snippet string  `json:"snippet"`
+	Score   float64 `json:"score"`
+}
+
+// Return the sections best matching the query, best first
+func (idx *manualIndex) search(query string, limit int) []searchResult {
+	const k1, b = 1.2, 0.75
+	scores := map[int]float64{}
+	terms := tokenize(query)
+	for _, term := range terms {
+		docs := idx.postings[term]
+		if len(docs) == 0 {
+			continue
+		}
+		n := float64(len(idx.sections))
+		idf := math.Log(1 + (n-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+		for doc, tf := range docs {
+			norm := k1 * (1 - b + b*float64(idx.lengths[doc])/idx.avgLength)
+			scores[doc] += idf * float64(tf) * (k1 + 1) / (float64(tf) + norm)
+		}
+	}
+	docs := make([]int, 0, len(scores))
+	for doc := range scores {
+		docs = append(docs, doc)
+	}
+	// Break ties by position, so that results are reproducible
+	sort.Slice(docs, func(i, j int) bool {
+		if scores[docs[i]] != scores[docs[j]] {
+			return scores[docs[i]] > scores[docs[j]]
+		}
+		return docs[i] < docs[j]
+	})
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	results := make([]searchResult, 0, len(docs))
+	for _, doc := range docs {
+		section := idx.sections[doc]
+		results = append(results, searchResult{
+			Key:     section.Manual,
+			Section: section.Heading,
+			Snippet: snippet(section.Text, terms),
+			Score:   math.Round(scores[doc]*100) / 100,
+		})
+	}
+	return results
+}
+
+// Return an excerpt of a text around the first occurrence of a term
+func snippet(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	start := -1
+	for _, term := range terms {
+		if i := strings.Index(lower, term); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	start -= snippetSize / 4
+	if start < 0 {
+		start = 0
+	}
+	// Lowercasing may change byte offsets of non-ASCII text
+	if start > len(text) {
+		start = 0
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	end := start + snippetSize
+	if end >= len(text) {
+		end = len(text)
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	excerpt := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		excerpt = "..." + excerpt
+	}
+	if end < len(text) {
+		excerpt += "..."
+	}
+	return excerpt
+}
+
+// Read a manual, or one of its sections.
+// Large manuals return their table of contents, unless a section is given.
+// An unknown section is a toolError, so that the model can pick another one.
+func readManual(man Manual, section string) (string, error) {
+	sections := splitSections(man)
+	if section == "" {
+		if len(man.Contents) <= maxManualRead {
+			return man.Contents, nil
+		}
+		var toc strings.Builder
+		fmt.Fprintf(&toc, "%s\n\nThis manual is long. Read one of its sections:\n", man.Description)
+		for i, s := range sections {
+			heading := s.Heading
+			if heading == "" {
+				heading = "(introduction)"
+			}
+			fmt.Fprintf(&toc, "%d. %s (%d bytes)\n", i+1, heading, len(s.Text))
+		}
+		return toc.String(), nil
+	}
+	// Sections are selected by heading, or by number in the table of contents
+	if n, err := strconv.Atoi(section); err == nil && n >= 1 && n <= len(sections) {
+		return sections[n-1].Text, nil
+	}
+	for _, s := range sections {
+		if strings.EqualFold(strings.TrimSpace(s.Heading), strings.TrimSpace(section)) {
+			return s.Text, nil
+		}
+	}
+	return "", toolErrorf("manual %s has no section %q", man.Name, section)
+}
+
+// Configure how manuals are offered to the model
+func (m Llm) WithKnowledgeMode(
+	// "tools" for a tool per manual, or "search" for a search tool and a read tool,
+	// better suited to large knowledge bases
+	mode string,
+) (Llm, error) {
+	switch mode {
+	case KnowledgeTools, KnowledgeSearch:
+	default:
+		return m, fmt.Errorf("unknown knowledge mode: %q", mode)
+	}
+	m.KnowledgeMode = mode
+	return m, nil
+}
+
+// The index of a set of manuals, built on first use
+type lazyManualIndex struct {
+	once  sync.Once
+	index *manualIndex
+}
+
+// Number of manual indexes kept in memory
+const maxManualIndexes = 8
+
+// Indexes of the most recently used sets of manuals, most recent first.
+// They are found by digest of the manuals they index, so that the manuals of a sandbox
+// are indexed once, rather than on every query.
+var manualIndexes struct {
+	sync.Mutex
+	entries []manualIndexEntry
+}
+
+type manualIndexEntry struct {
+	digest string
+	index  *lazyManualIndex
+}
+
+// Return the index of the manuals with the given digest, evicting the least recently used
+// index if there are too many
+func cachedManualIndex(digest string) *lazyManualIndex {
+	manualIndexes.Lock()
+	defer manualIndexes.Unlock()
+	entries := manualIndexes.entries
+	for i, entry := range entries {
+		if entry.digest == digest {
+			copy(entries[1:i+1], entries[:i])
+			entries[0] = entry
+			return entry.index
+		}
+	}
+	entry := manualIndexEntry{digest: digest, index: new(lazyManualIndex)}
+	entries = append([]manualIndexEntry{entry}, entries...)
+	if len(entries) > maxManualIndexes {
+		entries = entries[:maxManualIndexes]
+	}
+	manualIndexes.entries = entries
+	return entry.index
+}
+
+// Return a digest identifying a set of manuals
+func manualsDigest(manuals []Manual) string {
+	h := sha256.New()
+	for _, man := range manuals {
+		for _, field := range []string{man.Name, man.Description, man.Contents} {
+			// Prefix each field with its length, so that fields can't run into each other
+			fmt.Fprintf(h, "%d:%s", len(field), field)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (ts *toolServer) manualIndex() *manualIndex {
+	lazy := cachedManualIndex(manualsDigest(ts.manuals))
+	lazy.once.Do(func() {
+		lazy.index = newManualIndex(ts.manuals)
+	})
+	return lazy.index
+}
+
+type searchManualsTool struct {
+	*toolServer
+}
+
+func (t searchManualsTool) Name() string {
+	return "search_manuals"
+}
+
+func (t searchManualsTool) Description() string {
+	return "Search the instruction manuals. Returns the best matching sections, to read with read_manual."
+}
+
+func (t searchManualsTool) InputSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"query": map[string]string{
+				"type":        "string",
+				"description": "Keywords to search for",
+			},
+		},
+		"required": []string{"query"},
+	}
+}
+
+func (t searchManualsTool) ReadOnly() bool {
+	return true
+}
+
+func (t searchManualsTool) record(name, input string) {
+	t.toolServer.record(name, input)
+	t.log(sandboxEntry{Note: "🔎 " + input})
+}
+
+func (t searchManualsTool) Call(ctx context.Context, input string) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(input), &args); err != nil {
+		return "", toolErrorf("invalid input: %w", err)
+	}
+	results := t.manualIndex().search(args.Query, maxSearchResults)
+	data, err := json.Marshal(results)
+	return string(data), err
+}
+
+type readManualTool struct {
+	*toolServer
+}
+
+func (t readManualTool) Name() string {
+	return "read_manual"
+}
+
+func (t readManualTool) Description() string {
+	return "Read an instruction manual, or one of its sections. Long manuals return their table of contents."
+}
+
+func (t readManualTool) InputSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"key": map[string]string{
+				"type":        "string",
+				"description": "Key of the manual, as returned by search_manuals",
+			},
+			"section": map[string]string{
+				"type":        "string",
+				"description": "Heading or number of the section to read. Omit it to read the whole manual.",
+			},
+		},
+		"required": []string{"key"},
+	}
+}
+
+func (t readManualTool) ReadOnly() bool {
+	return true
+}
+
+func (t readManualTool) record(name, input string) {
+	t.toolServer.record(name, input)
+	t.log(sandboxEntry{Note: "📖 " + input})
+}
+
+func (t readManualTool) Call(ctx context.Context, input string) (string, error) {
+	var args struct {
+		Key     string `json:"key"`
+		Section string `json:"section"`
+	}
+	if err := json.Unmarshal([]byte(input), &args); err != nil {
+		return "", toolErrorf("invalid input: %w", err)
+	}
+	keys := make([]string, 0, len(t.manuals))
+	for _, man := range t.manuals {
+		if man.Name == args.Key {
+			return readManual(man, args.Section)
+		}
+		keys = append(keys, man.Name)
+	}
+	return "", toolErrorf("no such manual: %q. Manuals: %s", args.Key, strings.Join(keys, ", "))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadManualErrors(t *testing.T) {
+	ts := &toolServer{
+		manuals: []Manual{{
+			Name:        "go",
+			Description: "How to build Go programs",
+			Contents:    "# Build\n\nRun go build.\n\n# Test\n\nRun go test.\n",
+		}},
+		knowledgeMode: KnowledgeSearch,
+	}
+	results, err := callTools(context.Background(), []ToolCall{
+		{Name: "read_manual", Arguments: `{"key":"go","section":"Test"}`},
+		{Name: "read_manual", Arguments: `{"key":"rust"}`},
+		{Name: "read_manual", Arguments: `{"key":"go","section":"Deploy"}`},
+		{Name: "read_manual", Arguments: `{"key":`},
+		{Name: "search_manuals", Arguments: `"build"`},
+	}, ts.Tools())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].IsError || !strings.Contains(results[0].Output, "go test") {
+		t.Errorf("got %+v", results[0])
+	}
+	for _, result := range results[1:] {
+		if !result.IsError || result.Output == "" {
+			t.Errorf("expected an error result, got %+v", result)
+		}
+	}
+	if !strings.Contains(results[1].Output, "go") {
+		t.Errorf("expected the available manuals, got %q", results[1].Output)
+	}
+}
+
+func TestManualIndexReused(t *testing.T) {
+	manuals := []Manual{{Name: "go", Contents: "# Build\n\nRun go build.\n"}}
+	first := (&toolServer{manuals: manuals}).manualIndex()
+	second := (&toolServer{manuals: append([]Manual(nil), manuals...)}).manualIndex()
+	if first != second {
+		t.Fatal("expected the index to be reused")
+	}
+	other := (&toolServer{manuals: []Manual{{Name: "go", Contents: "# Test\n"}}}).manualIndex()
+	if other == first {
+		t.Fatal("expected a new index for other manuals")
+	}
+	if results := first.search("build", maxSearchResults); len(results) != 1 || results[0].Key != "go" {
+		t.Fatalf("got %+v", results)
+	}
+}
+
+func TestManualIndexEvicted(t *testing.T) {
+	index := func(i int) *manualIndex {
+		manuals := []Manual{{Name: "evicted", Contents: fmt.Sprintf("# Manual %d\n", i)}}
+		return (&toolServer{manuals: manuals}).manualIndex()
+	}
+	first := index(0)
+	for i := 1; i < maxManualIndexes; i++ {
+		index(i)
+	}
+	// Using an index keeps it
+	if index(0) != first {
+		t.Fatal("expected the index to be reused")
+	}
+	for i := maxManualIndexes; i < 2*maxManualIndexes; i++ {
+		index(i)
+	}
+	if index(0) == first {
+		t.Fatal("expected the least recently used index to be evicted")
+	}
+}
+
+// Sections are ranked by relevance, across manuals
+func TestManualIndexRanking(t *testing.T) {
+	idx := newManualIndex([]Manual{
+		{
+			Name:        "go",
+			Description: "Go programs",
+			Contents: "Go is a programming language.\n\n" +
+				"# Build\n\nRun go build to compile packages.\n\n" +
+				"# Test\n\nRun go test to test packages. Tests are functions named TestXxx.\n" +
+				"Test caching skips tests of unchanged packages.\n\n" +
+				"# Modules\n\nA module is a tree of packages, described by go.mod.\n",
+		},
+		{
+			Name:        "python",
+			Description: "Python programs",
+			Contents: "# Testing\n\nRun pytest.\n\n" +
+				"# Packaging\n\nBuild a wheel with python -m build.\n",
+		},
+	})
+	results := idx.search("test packages", maxSearchResults)
+	var got []string
+	for _, result := range results {
+		got = append(got, result.Key+"/"+result.Section)
+	}
+	// The section mentioning both terms most often comes first.
+	// Sections matching neither term are left out.
+	want := []string{"go/Test", "go/Build", "go/Modules"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Fatalf("results are not sorted by score: %+v", results)
+		}
+	}
+	if !strings.Contains(results[0].Snippet, "go test") {
+		t.Fatalf("got snippet %q", results[0].Snippet)
+	}
+	// Rare terms weigh more: "wheel" appears in a single section
+	if results := idx.search("build wheel", 1); len(results) != 1 || results[0].Key != "python" || results[0].Section != "Packaging" {
+		t.Fatalf("got %+v", results)
+	}
+	if results := idx.search("go", 2); len(results) != 2 {
+		t.Fatalf("expected the results to be limited, got %+v", results)
+	}
+	if results := idx.search("rust", maxSearchResults); len(results) != 0 {
+		t.Fatalf("got %+v", results)
+	}
+}
@@ -1,21 +1,63 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"dagger/llm/internal/dagger"
+	"dagger/llm/internal/telemetry"
+	"encoding/base64"
 	"encoding/json"
-
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var providers = []LlmProvider{
 	// Insert LLM implementations here
 	OpenAI{},
+	Anthropic{},
+	Ollama{},
+	// Most compatible servers serve the API under /v1
+	OpenAICompatible{OpenAI{basePath: "v1/"}},
 }
 
+const (
+	// Default maximum number of queries in a single Ask
+	defaultMaxSteps = 50
+	// Default number of identical consecutive tool calls considered a loop
+	defaultMaxRepeatedToolCalls = 3
+)
+
+// Reasons for stopping the agentic loop early, recorded by StopReason.
+// The Llm keeps the partial state and history, and can continue.
+var (
+	ErrTokenBudget    = errors.New("token budget exceeded")
+	ErrToolCallBudget = errors.New("tool call budget exceeded")
+	ErrStepLimit      = errors.New("step limit reached")
+	ErrToolCallLoop   = errors.New("tool call loop detected")
+)
+
+// Error returned when structured output still doesn't match its schema after all retries
+var ErrInvalidOutput = errors.New("structured output doesn't match the schema")
+
+// Error returned when attaching an image for a model that doesn't accept images
+var ErrVisionUnsupported = errors.New("model doesn't accept images")
+
 func New(
 	ctx context.Context,
-	// LLM model name
+	// LLM model name.
+	// Prefix it with a provider name to select the provider explicitly,
+	// eg. "anthropic/claude-3-5-haiku-latest" or "openai-compatible/qwen2.5-coder"
 	// +optional
 	// +default="gpt-4o"
 	model string,
@@ -28,15 +70,21 @@ func New(
 	// +optional
 	// +defaultPath="./system-prompt.txt"
 	systemPrompt *dagger.File,
+	// Stream replies token by token, instead of waiting for the full completion
+	// +optional
+	// +default=true
+	stream bool,
 ) (Llm, error) {
 	llm := Llm{
-		Model: model,
+		Model:                model,
+		Stream:               stream,
+		MaxSteps:             defaultMaxSteps,
+		MaxRepeatedToolCalls: defaultMaxRepeatedToolCalls,
+		Compaction:           defaultCompaction(),
+		KnowledgeMode:        KnowledgeTools,
+		ApprovalMode:         ApprovalOff,
 	}
-	sandbox, err := NewSandbox().WithUsername("🤖").ImportManuals(ctx, knowledgeDir)
-	if err != nil {
-		return llm, err
-	}
-	llm.Sandbox = sandbox
+	llm.Sandbox = dag.Sandbox().WithUsername("🤖").ImportManuals(knowledgeDir)
 	prompt, err := systemPrompt.Contents(ctx)
 	if err != nil {
 		return llm, err
@@ -51,44 +99,290 @@ type Llm struct {
 	Token *dagger.Secret // +private
 	// Optional API endpoint (eg. for local models)
 	Endpoint *dagger.Service // +private
-	// Opaque LLM state
-	State   string // +private
-	Sandbox Sandbox
+	// Stream replies token by token
+	Stream bool // +private
+	// Token usage accumulated over all queries
+	TokenUsage TokenUsage // +private
+	// Number of tool calls made by the model so far
+	ToolCalls int // +private
+	// Maximum number of tokens to use. Zero means no limit.
+	MaxTokens int // +private
+	// Maximum number of tool calls to make. Zero means no limit.
+	MaxToolCalls int // +private
+	// Maximum number of queries in a single Ask. Zero means no limit.
+	MaxSteps int // +private
+	// Maximum number of identical consecutive tool calls. Zero means no limit.
+	MaxRepeatedToolCalls int // +private
+	// The last tool call made by the model, and how many times in a row
+	LastToolCall    string // +private
+	ToolCallRepeats int    // +private
+	// How the history is kept within the model's context window
+	Compaction Compaction // +private
+	// JSON reply to the last AskStructured
+	LastOutput string // +private
+	// Why the last Ask, Continue or AskStructured stopped early, or empty
+	LastStopReason string // +private
+	// Tools offered to the model, in addition to the builtin tools
+	CustomTools []CustomTool // +private
+	// How manuals are offered to the model: "tools" or "search"
+	KnowledgeMode string // +private
+	// Which tool calls wait for approval: "off", "policy" or "side-effects"
+	ApprovalMode string // +private
+	// Tool calls of the last reply awaiting approval
+	Pending []PendingToolCall // +private
+	// LLM state, serialized in a versioned, provider-agnostic format
+	State string // +private
+	// The sandbox where the model runs scripts, and its history
+	Sandbox *dagger.Sandbox // +private
+}
+
+// Token counts reported by the LLM provider
+type TokenUsage struct {
+	// Tokens sent to the model, including history
+	PromptTokens int
+	// Tokens generated by the model
+	CompletionTokens int
+}
+
+func (u TokenUsage) add(other TokenUsage) TokenUsage {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	return u
+}
+
+// The result of a single API query
+type QueryResult struct {
+	// Reply text from the model
+	Reply string
+	// Tokens used by the query
+	Usage TokenUsage
+}
+
+// A message of the LLM history, in a provider-agnostic form.
+// Its JSON encoding is the serialized state format: see savedState.
+type Message struct {
+	// "system", "user", "assistant" or "tool"
+	Role string `json:"role"`
+	// Content of the message, in parts
+	Content []ContentPart `json:"content,omitempty"`
+	// Tool calls requested by the assistant
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// For tool results: the ID of the tool call
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// For tool results: the tool call failed
+	IsError bool `json:"is_error,omitempty"`
+}
+
+// A part of the content of a message
+type ContentPart struct {
+	// "text" or "image"
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	// For images: the media type, "image/png" or "image/jpeg"
+	MediaType string `json:"media_type,omitempty"`
+	// For images: the base64-encoded image
+	Data string `json:"data,omitempty"`
+}
+
+// Return content made of a single text part
+func textContent(text string) []ContentPart {
+	return []ContentPart{{Type: "text", Text: text}}
+}
+
+// Return the text of the message, joining its text parts
+func (msg Message) Text() string {
+	var text []string
+	for _, part := range msg.Content {
+		if part.Type == "text" {
+			text = append(text, part.Text)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// A tool call requested by the model
+type ToolCall struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	// JSON-encoded arguments
+	Arguments string `json:"arguments"`
 }
 
 type LlmProvider interface {
-	// Return a list of supported models
-	Models() []string
+	// Short provider name, to select it explicitly with "<name>/<model>"
+	Name() string
+	// Return true if the model name belongs to this provider, eg. by prefix
+	IsModel(string) bool
+	// List the models offered by the provider at the given base URL, or its default URL if empty
+	Models(ctx context.Context, baseURL string, token *dagger.Secret) ([]string, error)
+	// Return true if the model accepts images in prompts
+	Vision(model string) bool
 	// Initialize a new llm state
 	New() LlmState
-	// Load state from provider-specific serialized format
+	// Load state from the provider-specific format, saved before the state was versioned
 	Load(string) (LlmState, error)
 }
 
 type LlmState interface {
-	// Serialize the state to an opaque provider-specific string
-	Save() (string, error)
 	// Append a user prompt to the state, without sending
 	WithPrompt(string) LlmState
 	// Append a system prompt to the state, without sending
 	WithSystemPrompt(string) LlmState
-	// Send a single API query, and process replies and tool calls
+	// Append a user prompt made of several parts, eg. text and images, without sending
+	WithPromptContent([]ContentPart) LlmState
+	// Return the message history in a provider-agnostic form.
+	// It fails if the history can't be represented, rather than losing messages.
+	History() ([]Message, error)
+	// Replace the message history
+	WithHistory([]Message) LlmState
+	// Send a single API query, and process replies and tool calls.
+	// Requests go to the base URL, or to the provider's default URL if it is empty.
 	Query(
 		ctx context.Context,
 		model string,
-		endpoint *dagger.Service,
+		baseURL string,
+		token *dagger.Secret,
+		tools []Tool,
+	) (QueryResult, LlmState, error)
+	// Send a single API query with a streaming response, and process replies and tool calls.
+	// Reply text is passed to onDelta as it arrives.
+	QueryStream(
+		ctx context.Context,
+		model string,
+		baseURL string,
 		token *dagger.Secret,
 		tools []Tool,
-	) (string, LlmState, error)
+		onDelta func(string),
+	) (QueryResult, LlmState, error)
+	// Send a single API query, constraining the reply to JSON matching the schema.
+	// No tools are available to the model. The reply is not validated.
+	QueryStructured(
+		ctx context.Context,
+		model string,
+		baseURL string,
+		token *dagger.Secret,
+		schema map[string]interface{},
+	) (QueryResult, LlmState, error)
 }
 
 type Tool interface {
 	Name() string
 	Description() string
 	InputSchema() map[string]interface{}
+	// Return true if calls have no side effects, so that they can run concurrently
+	ReadOnly() bool
 	Call(ctx context.Context, input string) (string, error)
 }
 
+// Tools recording their calls, eg. for loop detection
+type callRecorder interface {
+	record(name, input string)
+}
+
+// Tools running outside the sandbox, and reporting each call as a run to log in its history.
+// Calls may run concurrently: callTools logs their runs once they are done, in the requested order.
+type toolRunner interface {
+	callRun(ctx context.Context, input string) (string, *toolRun, error)
+	logRun(run toolRun)
+}
+
+// An error reported to the model as the result of a tool call, rather than failing the query,
+// so that the model can recover, eg. by fixing its input
+type toolError struct {
+	err error
+}
+
+func toolErrorf(format string, args ...interface{}) error {
+	return toolError{fmt.Errorf(format, args...)}
+}
+
+func (e toolError) Error() string {
+	return e.err.Error()
+}
+
+func (e toolError) Unwrap() error {
+	return e.err
+}
+
+// The result of a tool call
+type toolResult struct {
+	Output string
+	// The call failed with a toolError: the output is the error message
+	IsError bool
+}
+
+// Run the tool calls requested in a single reply, and return their results in order.
+// Consecutive calls to read-only tools run concurrently. Other calls run alone,
+// in the requested order, so that their side effects are ordered too.
+func callTools(ctx context.Context, calls []ToolCall, tools []Tool) ([]toolResult, error) {
+	resolved := make([]Tool, len(calls))
+	for i, call := range calls {
+		for _, tool := range tools {
+			if tool.Name() == call.Name {
+				resolved[i] = tool
+				break
+			}
+		}
+		if resolved[i] == nil {
+			return nil, fmt.Errorf("tool not available: %s", call.Name)
+		}
+	}
+	// Stop before running any call if one awaits approval, so that the calls are resumed together
+	for i, call := range calls {
+		if gate, ok := resolved[i].(approvalGate); ok && gate.needsApproval(ctx, call.Arguments) {
+			return nil, ErrApprovalPending
+		}
+	}
+	results := make([]toolResult, len(calls))
+	runs := make([]*toolRun, len(calls))
+	errs := make([]error, len(calls))
+	for start := 0; start < len(calls); {
+		end := start + 1
+		if resolved[start].ReadOnly() {
+			for end < len(calls) && resolved[end].ReadOnly() {
+				end++
+			}
+		}
+		// Record calls before running any of them, so that the record is in the requested order,
+		// and recorders may change the tool server while no call runs
+		for i := start; i < end; i++ {
+			if recorder, ok := resolved[i].(callRecorder); ok {
+				recorder.record(calls[i].Name, calls[i].Arguments)
+			}
+		}
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if runner, ok := resolved[i].(toolRunner); ok {
+					results[i].Output, runs[i], errs[i] = runner.callRun(ctx, calls[i].Arguments)
+				} else {
+					results[i].Output, errs[i] = resolved[i].Call(ctx, calls[i].Arguments)
+				}
+			}(i)
+		}
+		wg.Wait()
+		// Log runs in the requested order, once no call runs, whichever finished first
+		for i := start; i < end; i++ {
+			if runs[i] != nil {
+				resolved[i].(toolRunner).logRun(*runs[i])
+			}
+		}
+		// Report the first error in the requested order, whichever failed first
+		for i := start; i < end; i++ {
+			var toolErr toolError
+			if errors.As(errs[i], &toolErr) {
+				results[i] = toolResult{Output: toolErr.Error(), IsError: true}
+			} else if errs[i] != nil {
+				return nil, errs[i]
+			}
+		}
+		start = end
+	}
+	return results, nil
+}
+
 // Configure an API token to authenticate against the LLM provider
 func (m Llm) WithToken(token *dagger.Secret) Llm {
 	m.Token = token
@@ -96,14 +390,99 @@ func (m Llm) WithToken(token *dagger.Secret) Llm {
 }
 
 // Configure an API endpoint to send LLM requests
-// Use this for local models, or hosted models that support multiple endpoints
+// Use this for local models, or hosted models that support multiple endpoints.
+// Models unknown to other providers are sent to the endpoint as an Ollama server,
+// unless a provider is selected explicitly in the model name.
 func (m Llm) WithEndpoint(endpoint *dagger.Service) Llm {
 	m.Endpoint = endpoint
 	return m
 }
 
-func (m Llm) WithSandbox(sandbox Sandbox) Llm {
-	m.Sandbox = sandbox
+// Stop asking once the total number of tokens used exceeds the given budget
+func (m Llm) WithMaxTokens(
+	// Maximum number of prompt and completion tokens. Zero means no limit.
+	max int,
+) Llm {
+	m.MaxTokens = max
+	return m
+}
+
+// Stop asking once the total number of tool calls exceeds the given budget
+func (m Llm) WithMaxToolCalls(
+	// Maximum number of tool calls. Zero means no limit.
+	max int,
+) Llm {
+	m.MaxToolCalls = max
+	return m
+}
+
+// Stop asking after the given number of queries in a single Ask
+func (m Llm) WithMaxSteps(
+	// Maximum number of queries. Zero means no limit.
+	max int,
+) Llm {
+	m.MaxSteps = max
+	return m
+}
+
+// Stop asking when the model repeats the same tool call, with the same input,
+// more than the given number of times in a row
+func (m Llm) WithMaxRepeatedToolCalls(
+	// Maximum number of identical consecutive tool calls. Zero means no limit.
+	max int,
+) Llm {
+	m.MaxRepeatedToolCalls = max
+	return m
+}
+
+// Configure how the history is compacted to fit the model's context window.
+// Before each query, large tool outputs are truncated; then old turns are
+// compacted until the history fits, then old steps of the recent turns.
+// The system prompt, the prompts of recent turns and the latest step are always kept.
+func (m Llm) WithCompaction(
+	// How to compact old turns: "none", "drop" or "summarize"
+	// +optional
+	// +default="drop"
+	strategy string,
+	// Estimated history size, in tokens, above which old turns are compacted. Zero means no limit.
+	// +optional
+	// +default=100000
+	maxTokens int,
+	// Maximum size of a single tool output, in bytes. Zero means no limit.
+	// +optional
+	// +default=20000
+	maxToolOutput int,
+	// Number of most recent turns compacted step by step, rather than whole
+	// +optional
+	// +default=2
+	keepTurns int,
+) (Llm, error) {
+	c := Compaction{
+		Strategy:      strategy,
+		MaxTokens:     maxTokens,
+		MaxToolOutput: maxToolOutput,
+		KeepTurns:     keepTurns,
+	}
+	if err := c.validate(); err != nil {
+		return m, err
+	}
+	m.Compaction = c
+	return m, nil
+}
+
+// Token usage accumulated over all queries
+func (m Llm) Usage() TokenUsage {
+	return m.TokenUsage
+}
+
+// Total number of tokens used so far, prompt and completion
+func (m Llm) TokensUsed() int {
+	return m.TokenUsage.PromptTokens + m.TokenUsage.CompletionTokens
+}
+
+// Enable or disable streaming of replies
+func (m Llm) WithStreaming(enabled bool) Llm {
+	m.Stream = enabled
 	return m
 }
 
@@ -113,10 +492,20 @@ func (m Llm) WithSecret(name string, value *dagger.Secret) Llm {
 }
 
 func (m Llm) WithDirectory(dir *dagger.Directory) Llm {
-	m.Sandbox = m.Sandbox.WithHome(m.Sandbox.Home.WithDirectory(".", dir))
+	m.Sandbox = m.Sandbox.WithHome(m.Sandbox.Home().WithDirectory(".", dir))
 	return m
 }
 
+// The sandbox's home directory, with the changes made so far
+func (m Llm) Directory() *dagger.Directory {
+	return m.Sandbox.Home()
+}
+
+// A patch of the changes made to the sandbox's home directory so far, including deletions
+func (m Llm) Patch() *dagger.File {
+	return m.Sandbox.ChangeSet().Patch()
+}
+
 // Configure a remote module as context for the sandbox
 func (m Llm) WithRemoteModule(address string) Llm {
 	m.Sandbox = m.Sandbox.WithRemoteModule(address)
@@ -129,12 +518,97 @@ func (m Llm) WithLocalModule(module *dagger.Directory) Llm {
 	return m
 }
 
-func (m Llm) History() []string {
-	return m.Sandbox.History
+// Configure the wall-clock timeout of sandbox runs and custom tool calls
+func (m Llm) WithRunTimeout(
+	// Timeout in seconds. Zero means no timeout.
+	seconds int,
+) Llm {
+	m.Sandbox = m.Sandbox.WithTimeout(seconds)
+	return m
+}
+
+// Configure the maximum size of the output of sandbox runs and custom tool calls.
+// Larger outputs keep their head and tail.
+func (m Llm) WithMaxRunOutput(
+	// Maximum size in bytes, for each of stdout and stderr. Zero means no limit.
+	size int,
+) Llm {
+	m.Sandbox = m.Sandbox.WithMaxOutput(size)
+	return m
+}
+
+// Add a rule to the command policy of the sandbox. Rules are checked in order, the first match decides.
+// The decision for a script is the most restrictive of the decisions for its commands and hosts.
+func (m Llm) WithPolicyRule(
+	// "allow", "deny" or "approve"
+	action string,
+	// A pattern where "*" matches any text, eg. "publish", "github.com/acme/*", "*.internal"
+	pattern string,
+	// What the pattern matches: "command" for command and function names, including module addresses,
+	// or "host" for hosts of URLs, module addresses and image references
+	// +optional
+	// +default="command"
+	target string,
+) Llm {
+	m.Sandbox = m.Sandbox.WithPolicyRule(action, pattern, dagger.SandboxWithPolicyRuleOpts{Target: target})
+	return m
+}
+
+// Configure the action of the sandbox policy for commands matching no rule
+func (m Llm) WithPolicyDefault(
+	// "allow", "deny" or "approve"
+	action string,
+) Llm {
+	m.Sandbox = m.Sandbox.WithPolicyDefault(action)
+	return m
+}
+
+// Export the session as a transcript: every prompt, reply, note and run, with timestamps
+func (m Llm) Transcript(
+	// "markdown", or "jsonl" for one JSON object per entry
+	// +optional
+	// +default="markdown"
+	format string,
+) *dagger.File {
+	return m.Sandbox.Transcript(dagger.SandboxTranscriptOpts{Format: format})
+}
+
+// Export the session as an asciicast v2 recording, to replay with asciinema
+func (m Llm) Asciicast(
+	// The width of the terminal
+	// +optional
+	// +default=120
+	width int,
+	// The height of the terminal
+	// +optional
+	// +default=40
+	height int,
+) *dagger.File {
+	return m.Sandbox.Asciicast(dagger.SandboxAsciicastOpts{Width: width, Height: height})
+}
+
+// List the models offered by the configured provider and endpoint
+func (m Llm) Models(ctx context.Context) ([]string, error) {
+	provider, _, err := m.llmProvider()
+	if err != nil {
+		return nil, err
+	}
+	baseURL, err := endpointURL(ctx, m.Endpoint, "")
+	if err != nil {
+		return nil, err
+	}
+	return provider.Models(ctx, baseURL, m.Token)
+}
+
+func (m Llm) History(ctx context.Context) ([]string, error) {
+	return m.Sandbox.History(ctx)
 }
 
 func (m Llm) WithPrompt(ctx context.Context, prompt string) (Llm, error) {
-	m.Sandbox = m.Sandbox.WithNote(ctx, prompt, "🧑")
+	if len(m.Pending) > 0 {
+		return m, fmt.Errorf("%w: decide them, then continue", ErrApprovalPending)
+	}
+	m = m.withNote(prompt, "🧑")
 	st, err := m.llmState()
 	if err != nil {
 		return m, err
@@ -143,8 +617,106 @@ func (m Llm) WithPrompt(ctx context.Context, prompt string) (Llm, error) {
 	return m.withLlmState(st)
 }
 
+// Attach a file to the prompt, without sending.
+// PNG and JPEG images are sent as images, to models accepting them. Other files are sent as text.
+func (m Llm) WithPromptFile(
+	ctx context.Context,
+	// The file to attach
+	file *dagger.File,
+	// A message to send along with the file
+	// +optional
+	prompt string,
+) (Llm, error) {
+	if len(m.Pending) > 0 {
+		return m, fmt.Errorf("%w: decide them, then continue", ErrApprovalPending)
+	}
+	name, err := file.Name(ctx)
+	if err != nil {
+		return m, err
+	}
+	contents, err := fileBytes(ctx, file)
+	if err != nil {
+		return m, err
+	}
+	parts, err := fileContent(name, contents)
+	if err != nil {
+		return m, err
+	}
+	if parts[0].Type == "image" {
+		provider, model, err := m.llmProvider()
+		if err != nil {
+			return m, err
+		}
+		if !provider.Vision(model) {
+			return m, fmt.Errorf("%s: %w: %s", name, ErrVisionUnsupported, model)
+		}
+		m = m.withNote("🖼️ "+name, "🧑")
+	} else {
+		m = m.withNote("📎 "+name, "🧑")
+	}
+	if prompt != "" {
+		parts = append(parts, textContent(prompt)...)
+		m = m.withNote(prompt, "🧑")
+	}
+	st, err := m.llmState()
+	if err != nil {
+		return m, err
+	}
+	return m.withLlmState(st.WithPromptContent(parts))
+}
+
+// Read the contents of a file, byte for byte.
+// File.Contents returns a GraphQL string, which mangles binary data such as images:
+// export the file to the module container instead.
+func fileBytes(ctx context.Context, file *dagger.File) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "prompt-file-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path, err := file.Export(ctx, filepath.Join(dir, "file"))
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Return the content of a prompt file: an image part for PNG and JPEG images,
+// or a text part for text files
+func fileContent(name string, contents []byte) ([]ContentPart, error) {
+	if mediaType := imageMediaType(contents); mediaType != "" {
+		return []ContentPart{{
+			Type:      "image",
+			MediaType: mediaType,
+			Data:      base64.StdEncoding.EncodeToString(contents),
+		}}, nil
+	}
+	if !utf8.Valid(contents) {
+		return nil, fmt.Errorf("%s: unsupported file type: attach text, PNG or JPEG files", name)
+	}
+	return textContent(fmt.Sprintf("File %s:\n\n%s", name, codeBlock("", string(contents)))), nil
+}
+
+// Return a fenced code block, with a fence longer than any backtick run in the code
+func codeBlock(lang, code string) string {
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + strings.TrimSuffix(code, "\n") + "\n" + fence + "\n"
+}
+
+// Return the media type of PNG and JPEG images, or an empty string for other data
+func imageMediaType(data []byte) string {
+	switch mediaType := http.DetectContentType(data); mediaType {
+	case "image/png", "image/jpeg":
+		return mediaType
+	}
+	return ""
+}
+
 func (m Llm) WithSystemPrompt(ctx context.Context, prompt string) (Llm, error) {
-	m.Sandbox = m.Sandbox.WithNote(ctx, prompt, "🧬")
+	m = m.withNote(prompt, "🧬")
 	st, err := m.llmState()
 	if err != nil {
 		return m, err
@@ -161,52 +733,362 @@ func (m Llm) Ask(
 	if err != nil {
 		return m, err
 	}
+	return m.Continue(ctx)
+}
+
+// Ask a question, and get the answer as JSON matching a schema.
+// Replies that don't match the schema are sent back to the model with the
+// validation error, until one matches or retries are exhausted.
+// The model can't call tools while answering: use Ask beforehand to let it work.
+// Read the answer with Output, which fails if no answer matched: StopReason tells why.
+// Schemas using keywords that can't be checked, like patternProperties or if/then/else, are refused.
+func (m Llm) AskStructured(
+	ctx context.Context,
+	// The message to send the model
+	prompt string,
+	// A JSON schema the answer must match
+	schema string,
+	// Number of queries to retry after an invalid answer
+	// +optional
+	// +default=2
+	retries int,
+) (Llm, error) {
+	var parsedSchema map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &parsedSchema); err != nil {
+		return m, fmt.Errorf("malformatted schema: %w", err)
+	}
+	if err := checkSchema(parsedSchema); err != nil {
+		return m, fmt.Errorf("unsupported schema: %w", err)
+	}
+	m, err := m.WithPrompt(ctx, prompt)
+	if err != nil {
+		return m, err
+	}
+	st, err := m.llmState()
+	if err != nil {
+		return m, err
+	}
+	_, model, err := m.llmProvider()
+	if err != nil {
+		return m, err
+	}
+	baseURL, err := endpointURL(ctx, m.Endpoint, "")
+	if err != nil {
+		return m, err
+	}
+	m.LastStopReason = ""
+	for attempt := 0; ; attempt++ {
+		m, st, err = m.compact(ctx, st)
+		if err != nil {
+			return m, err
+		}
+		var res QueryResult
+		res, st, err = st.QueryStructured(ctx, model, baseURL, m.Token, parsedSchema)
+		if err != nil {
+			return m, err
+		}
+		m.TokenUsage = m.TokenUsage.add(res.Usage)
+		verr := validateJSON(parsedSchema, res.Reply)
+		if verr == nil {
+			m.LastOutput = res.Reply
+			m = m.withNote(res.Reply, "📋")
+			return m.withLlmState(st)
+		}
+		m = m.withNote(res.Reply, "")
+		if attempt >= retries {
+			m.LastOutput = ""
+			return m.stop(ctx, st, fmt.Errorf("%w: %v", ErrInvalidOutput, verr))
+		}
+		if err := m.checkBudget(); err != nil {
+			return m.stop(ctx, st, err)
+		}
+		feedback := fmt.Sprintf("Your answer doesn't match the schema: %v\nAnswer again, with JSON matching the schema.", verr)
+		m = m.withNote(feedback, "🧑")
+		st = st.WithPrompt(feedback)
+	}
+}
+
+// The JSON answer to the last AskStructured, validated against its schema.
+// It fails if the last AskStructured stopped without a valid answer.
+func (m Llm) Output() (string, error) {
+	if m.LastOutput == "" {
+		if m.LastStopReason != "" {
+			return "", fmt.Errorf("no structured output: %s", m.LastStopReason)
+		}
+		return "", errors.New("no structured output: call AskStructured first")
+	}
+	return m.LastOutput, nil
+}
+
+// Why the last Ask, Continue or AskStructured stopped early, eg. a limit was reached,
+// or an empty string if it completed. Call Continue to resume after a limit.
+func (m Llm) StopReason() string {
+	return m.LastStopReason
+}
+
+// Stop the loop early: record why, and keep the state to continue from
+func (m Llm) stop(ctx context.Context, st LlmState, reason error) (Llm, error) {
+	m.LastStopReason = reason.Error()
+	m = m.withNote(reason.Error(), "🛑")
+	return m.withLlmState(st)
+}
+
+// Add a note to the sandbox history on behalf of a user, or of the model if the user is empty
+func (m Llm) withNote(note, username string) Llm {
+	m.Sandbox = m.Sandbox.WithNote(note, dagger.SandboxWithNoteOpts{Username: username})
+	return m
+}
+
+// Resume the agentic loop without a new prompt, eg. after it was stopped by a limit,
+// or once pending tool calls are decided
+func (m Llm) Continue(ctx context.Context) (Llm, error) {
 	st, err := m.llmState()
 	if err != nil {
 		return m, err
 	}
-	var reply string
-	for {
+	_, model, err := m.llmProvider()
+	if err != nil {
+		return m, err
+	}
+	baseURL, err := endpointURL(ctx, m.Endpoint, "")
+	if err != nil {
+		return m, err
+	}
+	if len(m.Pending) > 0 {
+		m, st, err = m.resumeToolCalls(ctx, st)
+		if err != nil {
+			return m, err
+		}
+	}
+	m.LastStopReason = ""
+	var res QueryResult
+	for step := 1; ; step++ {
+		m, st, err = m.compact(ctx, st)
+		if err != nil {
+			return m, err
+		}
 		// Each query gets a tool server instance with its own call counter.
-		toolServer := m.toolServer()
-		reply, st, err = st.Query(ctx, m.Model, m.Endpoint, m.Token, toolServer.Tools())
+		toolServer, err := m.toolServer(ctx)
 		if err != nil {
 			return m, err
 		}
-		if len(reply) != 0 {
-			toolServer.sandbox = toolServer.sandbox.WithNote(ctx, reply, "")
+		if m.Stream {
+			// Collect the reply as deltas arrive: the tool server logs it before the tool calls
+			onDelta := func(delta string) {
+				toolServer.reply += delta
+			}
+			res, st, err = st.QueryStream(ctx, model, baseURL, m.Token, toolServer.Tools(), onDelta)
+		} else {
+			res, st, err = st.Query(ctx, model, baseURL, m.Token, toolServer.Tools())
+			if (err == nil || errors.Is(err, ErrApprovalPending)) && len(res.Reply) != 0 {
+				toolServer.log(sandboxEntry{Note: res.Reply})
+			}
+		}
+		if errors.Is(err, ErrApprovalPending) {
+			m.Sandbox = toolServer.flush()
+			m.TokenUsage = m.TokenUsage.add(res.Usage)
+			return m.awaitApproval(ctx, st, toolServer.Tools())
+		}
+		if err != nil {
+			return m, err
 		}
-		m.Sandbox = toolServer.sandbox
+		m.Sandbox = toolServer.flush()
+		m.TokenUsage = m.TokenUsage.add(res.Usage)
+		m.ToolCalls += toolServer.Count()
 		if toolServer.Count() == 0 {
 			break
 		}
+		m = m.withToolCalls(toolServer.calls)
+		if err := m.checkLimits(step); err != nil {
+			return m.stop(ctx, st, err)
+		}
 	}
-	return m, nil
+	return m.withLlmState(st)
+}
+
+// Track repetitions of identical consecutive tool calls
+func (m Llm) withToolCalls(calls []string) Llm {
+	for _, call := range calls {
+		if call == m.LastToolCall {
+			m.ToolCallRepeats++
+		} else {
+			m.LastToolCall = call
+			m.ToolCallRepeats = 1
+		}
+	}
+	return m
 }
 
-func (m Llm) toolServer() toolServer {
-	return toolServer{
-		sandbox: m.Sandbox,
+// Return the reason if the loop must stop before the next step
+func (m Llm) checkLimits(step int) error {
+	if err := m.checkBudget(); err != nil {
+		return err
 	}
+	if m.MaxSteps > 0 && step >= m.MaxSteps {
+		return fmt.Errorf("%w: %d queries", ErrStepLimit, step)
+	}
+	if m.MaxRepeatedToolCalls > 0 && m.ToolCallRepeats > m.MaxRepeatedToolCalls {
+		return fmt.Errorf("%w: %d identical calls in a row: %s", ErrToolCallLoop, m.ToolCallRepeats, m.LastToolCall)
+	}
+	return nil
+}
+
+// Return the reason if a token or tool call budget is exceeded
+func (m Llm) checkBudget() error {
+	if m.MaxTokens > 0 && m.TokensUsed() > m.MaxTokens {
+		return fmt.Errorf("%w: used %d tokens, max %d", ErrTokenBudget, m.TokensUsed(), m.MaxTokens)
+	}
+	if m.MaxToolCalls > 0 && m.ToolCalls > m.MaxToolCalls {
+		return fmt.Errorf("%w: made %d tool calls, max %d", ErrToolCallBudget, m.ToolCalls, m.MaxToolCalls)
+	}
+	return nil
+}
+
+// Record token usage on a query span
+func recordUsage(span trace.Span, usage TokenUsage) {
+	span.SetAttributes(
+		attribute.Int("llm.usage.prompt_tokens", usage.PromptTokens),
+		attribute.Int("llm.usage.completion_tokens", usage.CompletionTokens),
+	)
+}
+
+// Return a tool server for a query, with what it needs to know about the sandbox
+func (m Llm) toolServer(ctx context.Context) (*toolServer, error) {
+	username, err := m.Sandbox.Username(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := m.Sandbox.Timeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manuals, err := loadManuals(ctx, m.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	return &toolServer{
+		sandbox:       m.Sandbox,
+		username:      username,
+		timeout:       timeout,
+		manuals:       manuals,
+		customTools:   m.CustomTools,
+		knowledgeMode: m.KnowledgeMode,
+		approvalMode:  m.ApprovalMode,
+	}, nil
 }
 
 type toolServer struct {
-	sandbox Sandbox
-	count   int
+	sandbox *dagger.Sandbox
+	// The sandbox user name, run timeout in seconds, and manuals
+	username      string
+	timeout       int
+	manuals       []Manual
+	customTools   []CustomTool
+	knowledgeMode string
+	approvalMode  string
+	// Tool calls made so far, as "<name> <input>"
+	calls []string
+	// The streamed reply, to log before the tool calls
+	reply string
+	// Entries to log in the sandbox history, in order, before the next script runs
+	pending []sandboxEntry
+}
+
+// An entry of the sandbox history: a note, or the run of a tool outside the sandbox
+type sandboxEntry struct {
+	Note string
+	Run  *toolRun
+}
+
+// A call of a tool outside the sandbox, logged in its history like a run
+type toolRun struct {
+	Tool     string
+	Input    string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// The call was interrupted by the sandbox timeout
+	TimedOut bool
+	Started  time.Time
+	Duration time.Duration
+}
+
+// Log the run in the history of a sandbox
+func (r toolRun) log(sandbox *dagger.Sandbox) *dagger.Sandbox {
+	return sandbox.WithToolRun(
+		r.Tool, r.Input, r.Stdout, r.Stderr, r.ExitCode,
+		r.Started.UTC().Format(time.RFC3339Nano), int(r.Duration.Milliseconds()),
+		dagger.SandboxWithToolRunOpts{TimedOut: r.TimedOut},
+	)
+}
+
+// Queue an entry for the sandbox history.
+// The streamed reply comes first: the model replies before its tool calls run.
+func (ts *toolServer) log(entry sandboxEntry) {
+	ts.logReply()
+	ts.pending = append(ts.pending, entry)
+}
+
+// Queue the streamed reply for the sandbox history, if any
+func (ts *toolServer) logReply() {
+	if ts.reply != "" {
+		ts.pending = append(ts.pending, sandboxEntry{Note: ts.reply})
+		ts.reply = ""
+	}
+}
+
+func (ts *toolServer) logRun(run toolRun) {
+	ts.log(sandboxEntry{Run: &run})
+}
+
+// Log the queued entries in the sandbox history, and return the sandbox
+func (ts *toolServer) flush() *dagger.Sandbox {
+	ts.logReply()
+	for _, entry := range ts.pending {
+		if entry.Run != nil {
+			ts.sandbox = entry.Run.log(ts.sandbox)
+		} else {
+			ts.sandbox = ts.sandbox.WithNote(entry.Note)
+		}
+	}
+	ts.pending = nil
+	return ts.sandbox
 }
 
 func (ts *toolServer) Count() int {
-	return ts.count
+	return len(ts.calls)
+}
+
+// Record a tool call. Inputs are compacted, so that calls differing only
+// by whitespace are identical.
+// Calls are recorded by callTools, before running them.
+func (ts *toolServer) record(name, input string) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(input)); err == nil {
+		input = compact.String()
+	}
+	ts.calls = append(ts.calls, name+" "+input)
 }
 
 func (ts *toolServer) Tools() []Tool {
 	var tools []Tool
 	tools = append(tools, daggerShellTool{ts})
-	for _, manual := range ts.sandbox.Manuals {
-		tools = append(tools, manualTool{
-			toolServer:  ts,
-			name:        manual.Name,
-			description: manual.Description,
+	switch {
+	case len(ts.manuals) == 0:
+	case ts.knowledgeMode == KnowledgeSearch:
+		tools = append(tools, searchManualsTool{ts}, readManualTool{ts})
+	default:
+		for _, manual := range ts.manuals {
+			tools = append(tools, manualTool{
+				toolServer: ts,
+				manual:     manual,
+			})
+		}
+	}
+	for _, spec := range ts.customTools {
+		tools = append(tools, customTool{
+			toolServer: ts,
+			spec:       spec,
 		})
 	}
 	return tools
@@ -236,71 +1118,135 @@ func (dsh daggerShellTool) InputSchema() map[string]interface{} {
 	}
 }
 
-func (dsh daggerShellTool) Call(ctx context.Context, input string) (string, error) {
-	fmt.Printf("shell tool call: %s")
+// Commands change the sandbox: calls must run one at a time
+func (dsh daggerShellTool) ReadOnly() bool {
+	return false
+}
+
+func (dsh daggerShellTool) needsApproval(ctx context.Context, input string) bool {
+	command, _ := dsh.command(input)
+	return dsh.toolServer.needsApproval(ctx, dsh.ReadOnly(), command)
+}
+
+func (dsh daggerShellTool) command(input string) (string, error) {
 	var args struct {
 		Command string `json:"command"`
 	}
-	if err := json.Unmarshal([]byte(input), &args); err != nil {
-		return "", err
-	}
-	dsh.count += 1
-	var err error
-	dsh.sandbox, err = dsh.sandbox.Run(ctx, args.Command)
-	if err != nil {
-		return "", err
-	}
-	result, err := dsh.sandbox.LastRun()
+	err := json.Unmarshal([]byte(input), &args)
+	return args.Command, err
+}
+
+func (dsh daggerShellTool) Call(ctx context.Context, input string) (string, error) {
+	command, err := dsh.command(input)
 	if err != nil {
 		return "", err
 	}
-	return result.ToJSON()
+	dsh.sandbox = dsh.flush().Run(command, dagger.SandboxRunOpts{Approved: isApproved(ctx)})
+	return dsh.sandbox.Result(ctx)
 }
 
 type manualTool struct {
 	*toolServer
-	name        string
-	description string
+	manual Manual
 }
 
 func (m manualTool) Name() string {
-	return m.name
+	return m.manual.Name
 }
 
 func (m manualTool) Description() string {
-	return m.description
+	return m.manual.Description
 }
 
 func (m manualTool) InputSchema() map[string]interface{} {
 	return nil
 }
 
+// Reading a manual doesn't change the sandbox
+func (m manualTool) ReadOnly() bool {
+	return true
+}
+
+// Log the read in the sandbox history. Calls are recorded one at a time, before running:
+// Call runs concurrently with other reads, and must not change the tool server.
+func (m manualTool) record(name, input string) {
+	m.toolServer.record(name, input)
+	m.log(sandboxEntry{Note: "📖 " + m.manual.Description})
+}
+
 func (m manualTool) Call(ctx context.Context, input string) (string, error) {
-	m.count += 1
-	return m.sandbox.ReadManual(ctx, m.name)
+	return m.manual.Contents, nil
 }
 
 func (m Llm) llmState() (LlmState, error) {
-	provider, err := m.llmProvider()
+	provider, _, err := m.llmProvider()
 	if err != nil {
 		return nil, err
 	}
-	return provider.Load(m.State)
+	return loadState(provider, m.State)
 }
 
 func (m Llm) withLlmState(st LlmState) (Llm, error) {
 	var err error
-	m.State, err = st.Save()
+	m.State, err = saveState(st)
 	return m, err
 }
 
-func (m Llm) llmProvider() (LlmProvider, error) {
-	for _, provider := range providers {
-		for _, model := range provider.Models() {
-			if model == m.Model {
-				return provider, nil
+// Select the provider for the configured model,
+// and return the model name to send to that provider.
+func (m Llm) llmProvider() (LlmProvider, string, error) {
+	// Explicit provider selection: "<provider>/<model>"
+	if name, model, ok := strings.Cut(m.Model, "/"); ok {
+		for _, provider := range providers {
+			if provider.Name() != name {
+				continue
 			}
+			if _, ok := provider.(OpenAICompatible); ok && m.Endpoint == nil {
+				return nil, "", fmt.Errorf("provider %s requires an endpoint", name)
+			}
+			return provider, model, nil
+		}
+	}
+	for _, provider := range providers {
+		if provider.IsModel(m.Model) {
+			return provider, m.Model, nil
+		}
+	}
+	// Local servers may serve any model: let Ollama try it
+	if m.Endpoint != nil {
+		return Ollama{}, m.Model, nil
+	}
+	return nil, "", fmt.Errorf("no provider for model: %s", m.Model)
+}
+
+// Stream reply text to the output of the current span, and to an optional callback.
+// Call done when the stream is over.
+func streamToSpan(ctx context.Context, onDelta func(string)) (write func(string), done func()) {
+	stdio := telemetry.SpanStdio(ctx, "")
+	write = func(delta string) {
+		if delta == "" {
+			return
+		}
+		io.WriteString(stdio.Stdout, delta)
+		if onDelta != nil {
+			onDelta(delta)
 		}
 	}
-	return nil, fmt.Errorf("no provider for model: %s", m.Model)
+	done = func() {
+		stdio.Close()
+	}
+	return write, done
+}
+
+// Return the base URL of an API endpoint, starting the service if needed.
+// Providers send requests to their default URL when it is empty.
+func endpointURL(ctx context.Context, endpoint *dagger.Service, defaultURL string) (string, error) {
+	if endpoint == nil {
+		return defaultURL, nil
+	}
+	endpoint, err := endpoint.Start(ctx)
+	if err != nil {
+		return "", err
+	}
+	return endpoint.Endpoint(ctx, dagger.ServiceEndpointOpts{Scheme: "http"})
 }
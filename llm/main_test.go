@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestFileContentImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 0xff, 0xff})
+		}
+	}
+	var pngData, jpegData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegData, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	for mediaType, data := range map[string][]byte{
+		"image/png":  pngData.Bytes(),
+		"image/jpeg": jpegData.Bytes(),
+	} {
+		// Images are binary: their bytes don't survive a UTF-8 string
+		if utf8.Valid(data) {
+			t.Fatalf("%s: expected invalid UTF-8", mediaType)
+		}
+		parts, err := fileContent("image", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != 1 || parts[0].Type != "image" || parts[0].MediaType != mediaType {
+			t.Fatalf("%s: got %+v", mediaType, parts)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(parts[0].Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%s: image data changed", mediaType)
+		}
+	}
+}
+
+func TestFileContentText(t *testing.T) {
+	parts, err := fileContent("notes.txt", []byte("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0].Type != "text" || !strings.Contains(parts[0].Text, "hello") {
+		t.Fatalf("got %+v", parts)
+	}
+	if _, err := fileContent("data.bin", []byte{0x00, 0xff, 0xfe}); err == nil {
+		t.Fatal("expected an error for binary data")
+	}
+}
+
+// Manual reads run concurrently, and are logged in the requested order
+func TestManualToolsConcurrent(t *testing.T) {
+	var manuals []Manual
+	var calls []ToolCall
+	for _, name := range []string{"a", "b", "c", "d"} {
+		manuals = append(manuals, Manual{Name: name, Description: "manual " + name, Contents: name})
+		calls = append(calls, ToolCall{Name: name, Arguments: "{}"})
+	}
+	ts := &toolServer{username: "agent", manuals: manuals}
+	// Leave room in the log, so that concurrent appends would share it
+	ts.pending = make([]sandboxEntry, 0, 16)
+	results, err := callTools(context.Background(), calls, ts.Tools())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Output != manuals[i].Name {
+			t.Errorf("call %d: got %q", i, result.Output)
+		}
+	}
+	var notes []string
+	for _, entry := range ts.pending {
+		notes = append(notes, entry.Note)
+	}
+	want := []string{"📖 manual a", "📖 manual b", "📖 manual c", "📖 manual d"}
+	if strings.Join(notes, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q", notes)
+	}
+}
+
+// A read-only tool reporting its calls as runs, finishing in the reverse order of the calls
+type runnerTool struct {
+	*toolServer
+}
+
+func (t runnerTool) Name() string                        { return "runner" }
+func (t runnerTool) Description() string                 { return "" }
+func (t runnerTool) InputSchema() map[string]interface{} { return nil }
+func (t runnerTool) ReadOnly() bool                      { return true }
+
+func (t runnerTool) Call(ctx context.Context, input string) (string, error) {
+	output, _, err := t.callRun(ctx, input)
+	return output, err
+}
+
+func (t runnerTool) callRun(ctx context.Context, input string) (string, *toolRun, error) {
+	delay := map[string]time.Duration{"1": 30 * time.Millisecond, "2": 15 * time.Millisecond}[input]
+	time.Sleep(delay)
+	run := toolRun{Tool: "runner", Input: input, Stdout: "out " + input, ExitCode: len(input) - 1}
+	return run.Stdout, &run, nil
+}
+
+// Runs of concurrent calls are logged in the requested order
+func TestCallToolsLogsRuns(t *testing.T) {
+	ts := &toolServer{username: "agent"}
+	tool := runnerTool{ts}
+	results, err := callTools(context.Background(), []ToolCall{
+		{Name: "runner", Arguments: "1"},
+		{Name: "runner", Arguments: "2"},
+		{Name: "runner", Arguments: "33"},
+	}, []Tool{tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[2].Output != "out 33" {
+		t.Fatalf("got %+v", results)
+	}
+	var inputs []string
+	for _, entry := range ts.pending {
+		if entry.Run == nil {
+			t.Fatalf("expected only runs, got %+v", ts.pending)
+		}
+		inputs = append(inputs, entry.Run.Input)
+	}
+	if strings.Join(inputs, " ") != "1 2 33" {
+		t.Fatalf("got %q", inputs)
+	}
+	if run := ts.pending[2].Run; run.Stdout != "out 33" || run.ExitCode != 1 {
+		t.Fatalf("got %+v", run)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	output, err := Llm{LastOutput: `{"a":1}`}.Output()
+	if err != nil || output != `{"a":1}` {
+		t.Fatalf("got %q, %v", output, err)
+	}
+	// Without a valid answer, Output fails with the reason
+	_, err = Llm{LastStopReason: "structured output doesn't match the schema: #: expected integer"}.Output()
+	if err == nil || !strings.Contains(err.Error(), "expected integer") {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := (Llm{}).Output(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
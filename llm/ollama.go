@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"dagger/llm/internal/dagger"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+const ollamaBaseURL = "http://localhost:11434"
+
+// A local Ollama server, talking its native chat API.
+// Bind it with Llm.WithEndpoint, for example:
+//
+//	dag.Llm(dagger.LlmOpts{Model: "llama3.2"}).WithEndpoint(dag.Ollama().Server("llama3.2").AsService())
+type Ollama struct{}
+
+func (o Ollama) Name() string {
+	return "ollama"
+}
+
+// Ollama serves whatever models were pulled locally, so no name is recognized statically.
+// Llm selects this provider for unknown models when an endpoint is configured.
+func (o Ollama) IsModel(model string) bool {
+	return false
+}
+
+// Vision models are recognized by name, as the server only knows the models it pulled
+func (o Ollama) Vision(model string) bool {
+	for _, name := range []string{"vision", "llava", "vl", "moondream", "minicpm-v", "gemma3", "mistral-small3"} {
+		if strings.Contains(model, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// List the models pulled on the server
+func (o Ollama) Models(ctx context.Context, baseURL string, token *dagger.Secret) ([]string, error) {
+	var res struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := ollamaRequestJSON(ctx, baseURL, token, http.MethodGet, "/api/tags", nil, &res); err != nil {
+		return nil, err
+	}
+	var models []string
+	for _, model := range res.Models {
+		models = append(models, model.Name)
+	}
+	return models, nil
+}
+
+func (o Ollama) New() LlmState {
+	return OllamaState{}
+}
+
+func (o Ollama) Load(data string) (LlmState, error) {
+	var st OllamaState
+	if data == "" {
+		return st, nil
+	}
+	if err := json.Unmarshal([]byte(data), &st.Messages); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// State of an Ollama session, safely serializable
+type OllamaState struct {
+	Messages []ollamaMessage
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Base64-encoded images
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	// The API matches tool results by order, and has no error flag:
+	// these are kept for the history only, and never sent.
+	ToolCallID string `json:"-"`
+	IsError    bool   `json:"-"`
+}
+
+type ollamaToolCall struct {
+	// Kept for the history only, and never sent
+	ID       string `json:"-"`
+	Function struct {
+		Name string `json:"name"`
+		// Unlike OpenAI, arguments are a JSON object, not an encoded string
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Parameters  map[string]interface{} `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	// A JSON schema constraining the reply
+	Format map[string]interface{} `json:"format,omitempty"`
+	Stream bool                   `json:"stream"`
+}
+
+type ollamaResponse struct {
+	Model   string        `json:"model"`
+	Message ollamaMessage `json:"message"`
+	Done    bool          `json:"done"`
+	// Token counts of the prompt and the reply
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+func (res *ollamaResponse) tokenUsage() TokenUsage {
+	return TokenUsage{
+		PromptTokens:     res.PromptEvalCount,
+		CompletionTokens: res.EvalCount,
+	}
+}
+
+// Append a user message (prompt) to the message history
+func (st OllamaState) WithPrompt(prompt string) LlmState {
+	st.Messages = append(st.Messages, ollamaMessage{
+		Role:    "user",
+		Content: prompt,
+	})
+	return st
+}
+
+// Append a user message made of text and images to the message history
+func (st OllamaState) WithPromptContent(parts []ContentPart) LlmState {
+	st.Messages = append(st.Messages, ollamaMessageFrom(Message{Role: "user", Content: parts}))
+	return st
+}
+
+// Append a system prompt message to the history
+func (st OllamaState) WithSystemPrompt(prompt string) LlmState {
+	st.Messages = append(st.Messages, ollamaMessage{
+		Role:    "system",
+		Content: prompt,
+	})
+	return st
+}
+
+// Return the message history in a provider-agnostic form
+func (st OllamaState) History() ([]Message, error) {
+	var messages []Message
+	for _, msg := range st.Messages {
+		message := Message{
+			Role:       msg.Role,
+			ToolCallID: msg.ToolCallID,
+			IsError:    msg.IsError,
+		}
+		if msg.Content != "" || len(msg.ToolCalls) == 0 {
+			message.Content = textContent(msg.Content)
+		}
+		for _, image := range msg.Images {
+			// Ollama doesn't keep media types: detect them
+			data, err := base64.StdEncoding.DecodeString(image)
+			if err != nil {
+				return nil, fmt.Errorf("decode image in a %s message: %w", msg.Role, err)
+			}
+			mediaType := imageMediaType(data)
+			if mediaType == "" {
+				return nil, fmt.Errorf("unsupported image type in a %s message: %s", msg.Role, http.DetectContentType(data))
+			}
+			message.Content = append(message.Content, ContentPart{
+				Type:      "image",
+				MediaType: mediaType,
+				Data:      image,
+			})
+		}
+		for _, call := range msg.ToolCalls {
+			message.ToolCalls = append(message.ToolCalls, ToolCall{
+				ID:        call.ID,
+				Name:      call.Function.Name,
+				Arguments: string(call.Function.Arguments),
+			})
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// Replace the message history
+func (st OllamaState) WithHistory(messages []Message) LlmState {
+	st.Messages = nil
+	for _, msg := range messages {
+		st.Messages = append(st.Messages, ollamaMessageFrom(msg))
+	}
+	return st
+}
+
+// Convert a provider-agnostic message to an Ollama message
+func ollamaMessageFrom(msg Message) ollamaMessage {
+	// Ollama takes plain text content, and images apart
+	message := ollamaMessage{
+		Role:       msg.Role,
+		Content:    msg.Text(),
+		ToolCallID: msg.ToolCallID,
+		IsError:    msg.IsError,
+	}
+	for _, part := range msg.Content {
+		if part.Type == "image" {
+			message.Images = append(message.Images, part.Data)
+		}
+	}
+	for _, call := range msg.ToolCalls {
+		var c ollamaToolCall
+		c.ID = call.ID
+		c.Function.Name = call.Name
+		c.Function.Arguments = json.RawMessage(call.Arguments)
+		message.ToolCalls = append(message.ToolCalls, c)
+	}
+	return message
+}
+
+// Send a chat API query, process tool calls, and return the reply text
+func (st OllamaState) Query(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	tools []Tool,
+) (QueryResult, LlmState, error) {
+	res, err := st.sendQuery(ctx, baseURL, token, st.request(model, tools))
+	if err != nil {
+		return QueryResult{}, st, err
+	}
+	return st.processReply(ctx, res, tools)
+}
+
+// Send a streaming chat API query, process tool calls, and return the reply text
+func (st OllamaState) QueryStream(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	tools []Tool,
+	onDelta func(string),
+) (QueryResult, LlmState, error) {
+	res, err := st.sendQueryStream(ctx, baseURL, token, st.request(model, tools), onDelta)
+	if err != nil {
+		return QueryResult{}, st, err
+	}
+	return st.processReply(ctx, res, tools)
+}
+
+// Send a chat API query with the reply constrained to the schema, and return the reply JSON
+func (st OllamaState) QueryStructured(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	schema map[string]interface{},
+) (QueryResult, LlmState, error) {
+	req := st.request(model, nil)
+	req.Format = schema
+	res, err := st.sendQuery(ctx, baseURL, token, req)
+	if err != nil {
+		return QueryResult{}, st, err
+	}
+	return st.processReply(ctx, res, nil)
+}
+
+// Add the model reply to the history, and handle its tool calls
+func (st OllamaState) processReply(ctx context.Context, res *ollamaResponse, tools []Tool) (QueryResult, LlmState, error) {
+	reply := res.Message
+	result := QueryResult{
+		Reply: reply.Content,
+		Usage: res.tokenUsage(),
+	}
+	// Handle tool calls. Ollama doesn't assign call IDs: results are matched by order.
+	var calls []ToolCall
+	for i, call := range reply.ToolCalls {
+		input := string(call.Function.Arguments)
+		if input == "" || input == "null" {
+			// Send calls without arguments back with an empty object, not null
+			input = "{}"
+			reply.ToolCalls[i].Function.Arguments = json.RawMessage(input)
+		}
+		calls = append(calls, ToolCall{Name: call.Function.Name, Arguments: input})
+	}
+	st.Messages = append(st.Messages, reply)
+	outputs, err := callTools(ctx, calls, tools)
+	if err != nil {
+		return result, st, err
+	}
+	for _, output := range outputs {
+		st.Messages = append(st.Messages, ollamaMessage{
+			Role:    "tool",
+			Content: output.Output,
+			IsError: output.IsError,
+		})
+	}
+	return result, st, nil
+}
+
+func (st OllamaState) sendQuery(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	req ollamaRequest,
+) (res *ollamaResponse, rerr error) {
+	ctx, span := Tracer().Start(ctx, "[🤖] 💭")
+	defer func() {
+		if rerr != nil {
+			span.SetStatus(codes.Error, rerr.Error())
+		}
+		span.End()
+	}()
+	res = new(ollamaResponse)
+	if err := ollamaRequestJSON(ctx, baseURL, token, http.MethodPost, "/api/chat", req, res); err != nil {
+		return nil, err
+	}
+	recordUsage(span, res.tokenUsage())
+	return res, nil
+}
+
+func (st OllamaState) sendQueryStream(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	req ollamaRequest,
+	onDelta func(string),
+) (res *ollamaResponse, rerr error) {
+	ctx, span := Tracer().Start(ctx, "[🤖] 💭")
+	defer func() {
+		if rerr != nil {
+			span.SetStatus(codes.Error, rerr.Error())
+		}
+		span.End()
+	}()
+	req.Stream = true
+	httpRes, err := ollamaDo(ctx, baseURL, token, http.MethodPost, "/api/chat", req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+	write, done := streamToSpan(ctx, onDelta)
+	defer done()
+	// The stream is a sequence of JSON objects, each with a partial message
+	res = &ollamaResponse{Message: ollamaMessage{Role: "assistant"}}
+	dec := json.NewDecoder(httpRes.Body)
+	for {
+		var chunk ollamaResponse
+		if err := dec.Decode(&chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("ollama: malformatted stream: %w", err)
+		}
+		res.Model = chunk.Model
+		res.Message.Content += chunk.Message.Content
+		res.Message.ToolCalls = append(res.Message.ToolCalls, chunk.Message.ToolCalls...)
+		write(chunk.Message.Content)
+		if chunk.Done {
+			// Only the last chunk has the token counts
+			res.Done = true
+			res.PromptEvalCount = chunk.PromptEvalCount
+			res.EvalCount = chunk.EvalCount
+			break
+		}
+	}
+	recordUsage(span, res.tokenUsage())
+	return res, nil
+}
+
+func (st OllamaState) request(model string, tools []Tool) ollamaRequest {
+	req := ollamaRequest{
+		Model:    model,
+		Messages: st.Messages,
+	}
+	for _, tool := range tools {
+		var t ollamaTool
+		t.Type = "function"
+		t.Function.Name = tool.Name()
+		t.Function.Description = tool.Description()
+		t.Function.Parameters = tool.InputSchema()
+		if t.Function.Parameters == nil {
+			t.Function.Parameters = map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			}
+		}
+		req.Tools = append(req.Tools, t)
+	}
+	return req
+}
+
+// Send a request to the Ollama API, and decode the JSON response
+func ollamaRequestJSON(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	method, path string,
+	in, out interface{},
+) error {
+	httpRes, err := ollamaDo(ctx, baseURL, token, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+	data, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("ollama: malformatted response: %w", err)
+	}
+	return nil
+}
+
+// Send a request to the Ollama API, and check the response status.
+// The caller must close the response body.
+func ollamaDo(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	method, path string,
+	in interface{},
+) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	if baseURL == "" {
+		baseURL = ollamaBaseURL
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	// Ollama doesn't authenticate, but a proxy in front of it might
+	if token != nil {
+		key, err := token.Plaintext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+key)
+	}
+	httpRes, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		defer httpRes.Body.Close()
+		data, _ := io.ReadAll(httpRes.Body)
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &apiErr); err == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("ollama: %s", apiErr.Error)
+		}
+		return nil, fmt.Errorf("ollama: unexpected status %s: %s", httpRes.Status, data)
+	}
+	return httpRes, nil
+}
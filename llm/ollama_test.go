@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestOllamaQuery(t *testing.T) {
+	api := newFakeAPI(t, "/api/chat",
+		`{"model":"llama-test","message":{"role":"assistant","content":"Let me check.","tool_calls":[
+			{"function":{"name":"echo","arguments":{"text":"hi"}}},
+			{"function":{"name":"echo"}},
+			{"function":{"name":"echo","arguments":{"text":"fail"}}}
+		]},"done":true,"prompt_eval_count":10,"eval_count":5}`,
+		`{"model":"llama-test","message":{"role":"assistant","content":"Done."},"done":true,"prompt_eval_count":20,"eval_count":2}`,
+	)
+	tool := &echoTool{name: "echo"}
+	st := Ollama{}.New().WithSystemPrompt("Be brief").WithPrompt("Echo hi")
+	res, st, err := st.Query(context.Background(), "llama-test", api.URL, nil, []Tool{tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reply != "Let me check." || res.Usage.PromptTokens != 10 || res.Usage.CompletionTokens != 5 {
+		t.Fatalf("got %+v", res)
+	}
+	if strings.Join(tool.calls, " ") != `{"text":"hi"} {} {"text":"fail"}` {
+		t.Fatalf("got calls %q", tool.calls)
+	}
+	req := api.requests[0]
+	if req["model"] != "llama-test" || req["stream"] != false {
+		t.Fatalf("got request %v", req)
+	}
+	// The system prompt is the first message
+	if jsonPath(req, "messages", 0, "role") != "system" || jsonPath(req, "messages", 0, "content") != "Be brief" {
+		t.Fatalf("got messages %v", req["messages"])
+	}
+	if jsonPath(req, "tools", 0, "function", "name") != "echo" || jsonPath(req, "tools", 0, "function", "parameters", "type") != "object" {
+		t.Fatalf("got tools %v", req["tools"])
+	}
+
+	res, _, err = st.Query(context.Background(), "llama-test", api.URL, nil, []Tool{tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reply != "Done." {
+		t.Fatalf("got %+v", res)
+	}
+	// Tool results follow the calls in order, one message each
+	messages := jsonPath(api.requests[1], "messages").([]interface{})
+	if len(messages) != 6 {
+		t.Fatalf("got messages %v", messages)
+	}
+	if input, ok := jsonPath(messages, 2, "tool_calls", 1, "function", "arguments").(map[string]interface{}); !ok || len(input) != 0 {
+		t.Fatalf("expected empty arguments for a call without arguments, got %v", messages[2])
+	}
+	for i, want := range []string{`echo {"text":"hi"}`, "echo {}", `failed: {"text":"fail"}`} {
+		if jsonPath(messages, 3+i, "role") != "tool" || jsonPath(messages, 3+i, "content") != want {
+			t.Errorf("result %d: got %v", i, messages[3+i])
+		}
+	}
+}
+
+func TestOllamaQueryStream(t *testing.T) {
+	api := newFakeAPI(t, "/api/chat",
+		`{"model":"llama-test","message":{"role":"assistant","content":"Let me "},"done":false}
+{"model":"llama-test","message":{"role":"assistant","content":"check."},"done":false}
+{"model":"llama-test","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"echo","arguments":{"text":"hi"}}},{"function":{"name":"echo"}}]},"done":false}
+{"model":"llama-test","message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":10,"eval_count":8}
+`,
+		`{"model":"llama-test","message":{"role":"assistant","content":"Done."},"done":false}
+{"model":"llama-test","message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":20,"eval_count":2}
+`,
+	)
+	tool := &echoTool{name: "echo"}
+	var deltas []string
+	onDelta := func(delta string) { deltas = append(deltas, delta) }
+	st := Ollama{}.New().WithPrompt("Echo hi")
+	res, st, err := st.QueryStream(context.Background(), "llama-test", api.URL, nil, []Tool{tool}, onDelta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reply != "Let me check." || strings.Join(deltas, "|") != "Let me |check." {
+		t.Fatalf("got %+v, deltas %q", res, deltas)
+	}
+	if res.Usage.PromptTokens != 10 || res.Usage.CompletionTokens != 8 {
+		t.Fatalf("got usage %+v", res.Usage)
+	}
+	if strings.Join(tool.calls, " ") != `{"text":"hi"} {}` {
+		t.Fatalf("got calls %q", tool.calls)
+	}
+	if api.requests[0]["stream"] != true {
+		t.Fatalf("got request %v", api.requests[0])
+	}
+
+	if _, _, err := st.QueryStream(context.Background(), "llama-test", api.URL, nil, []Tool{tool}, onDelta); err != nil {
+		t.Fatal(err)
+	}
+	messages := jsonPath(api.requests[1], "messages").([]interface{})
+	if len(messages) != 4 || jsonPath(messages, 1, "content") != "Let me check." {
+		t.Fatalf("got messages %v", messages)
+	}
+	if input, ok := jsonPath(messages, 1, "tool_calls", 1, "function", "arguments").(map[string]interface{}); !ok || len(input) != 0 {
+		t.Fatalf("expected empty arguments for a call without arguments, got %v", messages[1])
+	}
+}
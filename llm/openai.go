@@ -5,60 +5,104 @@ import (
 	"dagger/llm/internal/dagger"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
 	"go.opentelemetry.io/otel/codes"
 )
 
-type OpenAI struct{}
-
-func (oai OpenAI) Models() []string {
-	return []string{
-		"o1-preview",                         // ModelNameO1Preview
-		"o1-preview-2024-09-12",              // ModelNameO1Preview2024_09_12
-		"o1-mini",                            // ModelNameO1Mini
-		"o1-mini-2024-09-12",                 // ModelNameO1Mini2024_09_12
-		"gpt-4o",                             // ModelNameGPT4o
-		"gpt-4o-2024-11-20",                  // ModelNameGPT4o2024_11_20
-		"gpt-4o-2024-08-06",                  // ModelNameGPT4o2024_08_06
-		"gpt-4o-2024-05-13",                  // ModelNameGPT4o2024_05_13
-		"gpt-4o-realtime-preview",            // ModelNameGPT4oRealtimePreview
-		"gpt-4o-realtime-preview-2024-10-01", // ModelNameGPT4oRealtimePreview2024_10_01
-		"gpt-4o-audio-preview",               // ModelNameGPT4oAudioPreview
-		"gpt-4o-audio-preview-2024-10-01",    // ModelNameGPT4oAudioPreview2024_10_01
-		"chatgpt-4o-latest",                  // ModelNameChatgpt4oLatest
-		"gpt-4o-mini",                        // ModelNameGPT4oMini
-		"gpt-4o-mini-2024-07-18",             // ModelNameGPT4oMini2024_07_18
-		"gpt-4-turbo",                        // ModelNameGPT4Turbo
-		"gpt-4-turbo-2024-04-09",             // ModelNameGPT4Turbo2024_04_09
-		"gpt-4-0125-preview",                 // ModelNameGPT4_0125Preview
-		"gpt-4-turbo-preview",                // ModelNameGPT4TurboPreview
-		"gpt-4-1106-preview",                 // ModelNameGPT4_1106Preview
-		"gpt-4-vision-preview",               // ModelNameGPT4VisionPreview
-		"gpt-4",                              // ModelNameGPT4
-		"gpt-4-0314",                         // ModelNameGPT4_0314
-		"gpt-4-0613",                         // ModelNameGPT4_0613
-		"gpt-4-32k",                          // ModelNameGPT4_32k
-		"gpt-4-32k-0314",                     // ModelNameGPT4_32k0314
-		"gpt-4-32k-0613",                     // ModelNameGPT4_32k0613
-		"gpt-3.5-turbo",                      // ModelNameGPT3_5Turbo
-		"gpt-3.5-turbo-16k",                  // ModelNameGPT3_5Turbo16k
-		"gpt-3.5-turbo-0301",                 // ModelNameGPT3_5Turbo0301
-		"gpt-3.5-turbo-0613",                 // ModelNameGPT3_5Turbo0613
-		"gpt-3.5-turbo-1106",                 // ModelNameGPT3_5Turbo1106
-		"gpt-3.5-turbo-0125",                 // ModelNameGPT3_5Turbo0125
-		"gpt-3.5-turbo-16k-0613",             // ModelNameGPT3_5Turbo16k0613
+type OpenAI struct {
+	// Path of the API under a custom endpoint
+	basePath string
+}
+
+func (oai OpenAI) Name() string {
+	return "openai"
+}
+
+// Match OpenAI model families by prefix, so new models don't need a code change
+func (oai OpenAI) IsModel(model string) bool {
+	for _, prefix := range []string{"gpt-", "chatgpt-", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// List the models offered by the endpoint
+func (oai OpenAI) Models(ctx context.Context, baseURL string, token *dagger.Secret) ([]string, error) {
+	client, err := oai.client(ctx, baseURL, token)
+	if err != nil {
+		return nil, err
+	}
+	var models []string
+	iter := client.Models.ListAutoPaging(ctx)
+	for iter.Next() {
+		models = append(models, iter.Current().ID)
+	}
+	return models, iter.Err()
+}
+
+// GPT-4 models before GPT-4 Turbo, GPT-3.5 and small reasoning models don't accept images
+func (oai OpenAI) Vision(model string) bool {
+	switch {
+	case strings.HasPrefix(model, "gpt-4-turbo"):
+		return true
+	case model == "gpt-4", strings.HasPrefix(model, "gpt-4-"), strings.HasPrefix(model, "gpt-3.5"),
+		strings.HasPrefix(model, "o1-mini"), strings.HasPrefix(model, "o3-mini"):
+		return false
+	}
+	return true
+}
+
+func (oai OpenAI) client(ctx context.Context, baseURL string, token *dagger.Secret) (*openai.Client, error) {
+	opts := []option.RequestOption{option.WithHeader("Content-Type", "application/json")}
+	if token != nil {
+		key, err := token.Plaintext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithAPIKey(key))
+	}
+	if baseURL != "" {
+		opts = append(opts, option.WithBaseURL(strings.TrimSuffix(baseURL, "/")+"/"+oai.basePath))
 	}
+	return openai.NewClient(opts...), nil
+}
+
+// Any server implementing the OpenAI chat completions API: vLLM, LM Studio, llama.cpp...
+// It accepts any model name, so it is never selected implicitly:
+// use "openai-compatible/<model>" with a configured endpoint.
+type OpenAICompatible struct {
+	OpenAI
+}
+
+func (oai OpenAICompatible) Name() string {
+	return "openai-compatible"
+}
+
+func (oai OpenAICompatible) IsModel(model string) bool {
+	return false
+}
+
+// Models are unknown: the server rejects images itself if the model doesn't accept them
+func (oai OpenAICompatible) Vision(model string) bool {
+	return true
 }
 
 func (oai OpenAI) New() LlmState {
-	return OpenAIState{}
+	return OpenAIState{provider: oai}
 }
 
 // State of an OpenAI session, safely serializable
 type OpenAIState struct {
-	history []openai.ChatCompletionMessageParamUnion
+	provider OpenAI
+	history  []openai.ChatCompletionMessageParamUnion
+	// IDs of the calls with failed results: the API has no error flag for tool results,
+	// so it is kept apart for the history.
+	failedCalls map[string]bool
 }
 
 // Append a user message (prompt) to the message history
@@ -67,45 +111,253 @@ func (st OpenAIState) WithPrompt(prompt string) LlmState {
 	return st
 }
 
+// Append a user message made of several parts to the message history
+func (st OpenAIState) WithPromptContent(parts []ContentPart) LlmState {
+	st.history = append(st.history, openAIMessageParam(Message{Role: "user", Content: parts}))
+	return st
+}
+
 // Append a system prompt message to the history
 func (st OpenAIState) WithSystemPrompt(prompt string) LlmState {
 	st.history = append(st.history, openai.SystemMessage(prompt))
 	return st
 }
 
+// Return the message history in a provider-agnostic form
+func (st OpenAIState) History() ([]Message, error) {
+	// Param types have no common accessors: go through their JSON encoding
+	data, err := json.Marshal(st.history)
+	if err != nil {
+		return nil, fmt.Errorf("encode history: %w", err)
+	}
+	messages, err := decodeOpenAIMessages(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode history: %w", err)
+	}
+	for i, msg := range messages {
+		if msg.Role == "tool" && st.failedCalls[msg.ToolCallID] {
+			messages[i].IsError = true
+		}
+	}
+	return messages, nil
+}
+
+// Replace the message history
+func (st OpenAIState) WithHistory(messages []Message) LlmState {
+	st.history = nil
+	st.failedCalls = nil
+	for _, msg := range messages {
+		if param := openAIMessageParam(msg); param != nil {
+			st.history = append(st.history, param)
+		}
+		if msg.Role == "tool" && msg.IsError {
+			st = st.withFailedCall(msg.ToolCallID)
+		}
+	}
+	return st
+}
+
+// Record the failed result of a tool call, without changing the results of other states
+func (st OpenAIState) withFailedCall(id string) OpenAIState {
+	failed := map[string]bool{id: true}
+	for id := range st.failedCalls {
+		failed[id] = true
+	}
+	st.failedCalls = failed
+	return st
+}
+
+// Convert a provider-agnostic message to a chat completion message param
+func openAIMessageParam(msg Message) openai.ChatCompletionMessageParamUnion {
+	var text []openai.ChatCompletionContentPartTextParam
+	for _, part := range msg.Content {
+		if part.Type == "text" {
+			text = append(text, openai.TextPart(part.Text))
+		}
+	}
+	switch msg.Role {
+	case "system":
+		return openai.ChatCompletionSystemMessageParam{
+			Role:    openai.F(openai.ChatCompletionSystemMessageParamRoleSystem),
+			Content: openai.F(text),
+		}
+	case "user":
+		// User messages can have images too, as data URLs
+		var parts []openai.ChatCompletionContentPartUnionParam
+		for _, part := range msg.Content {
+			switch part.Type {
+			case "text":
+				parts = append(parts, openai.TextPart(part.Text))
+			case "image":
+				parts = append(parts, openai.ImagePart("data:"+part.MediaType+";base64,"+part.Data))
+			}
+		}
+		return openai.UserMessageParts(parts...)
+	case "tool":
+		return openai.ChatCompletionToolMessageParam{
+			Role:       openai.F(openai.ChatCompletionToolMessageParamRoleTool),
+			ToolCallID: openai.F(msg.ToolCallID),
+			Content:    openai.F(text),
+		}
+	case "assistant":
+		param := openai.ChatCompletionAssistantMessageParam{
+			Role: openai.F(openai.ChatCompletionAssistantMessageParamRoleAssistant),
+		}
+		// Content is optional when there are tool calls
+		if len(text) > 0 {
+			var parts []openai.ChatCompletionAssistantMessageParamContentUnion
+			for _, part := range text {
+				parts = append(parts, part)
+			}
+			param.Content = openai.F(parts)
+		}
+		if len(msg.ToolCalls) > 0 {
+			var calls []openai.ChatCompletionMessageToolCallParam
+			for _, call := range msg.ToolCalls {
+				calls = append(calls, openai.ChatCompletionMessageToolCallParam{
+					ID:   openai.F(call.ID),
+					Type: openai.F(openai.ChatCompletionMessageToolCallTypeFunction),
+					Function: openai.F(openai.ChatCompletionMessageToolCallFunctionParam{
+						Name:      openai.F(call.Name),
+						Arguments: openai.F(call.Arguments),
+					}),
+				})
+			}
+			param.ToolCalls = openai.F(calls)
+		}
+		return param
+	}
+	return nil
+}
+
 // Send a chat completion API query, process tool calls, and return the reply text
 func (s OpenAIState) Query(
 	ctx context.Context,
 	model string,
-	endpoint *dagger.Service,
+	baseURL string,
 	token *dagger.Secret,
 	tools []Tool,
-) (string, LlmState, error) {
-	res, err := s.sendQuery(ctx, model, endpoint, token, tools)
+) (QueryResult, LlmState, error) {
+	res, err := s.sendQuery(ctx, baseURL, token, s.params(model, tools))
+	if err != nil {
+		return QueryResult{}, s, err
+	}
+	return s.processReply(ctx, res, tools)
+}
+
+// Send a streaming chat completion API query, process tool calls, and return the reply text
+func (s OpenAIState) QueryStream(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	tools []Tool,
+	onDelta func(string),
+) (QueryResult, LlmState, error) {
+	res, err := s.sendQueryStream(ctx, baseURL, token, s.params(model, tools), onDelta)
+	if err != nil {
+		return QueryResult{}, s, err
+	}
+	return s.processReply(ctx, res, tools)
+}
+
+// Send a chat completion API query in structured output mode, and return the reply JSON
+func (s OpenAIState) QueryStructured(
+	ctx context.Context,
+	model string,
+	baseURL string,
+	token *dagger.Secret,
+	schema map[string]interface{},
+) (QueryResult, LlmState, error) {
+	params := s.params(model, nil)
+	// Strict mode only supports a subset of JSON schema: replies are validated by the caller instead
+	params.ResponseFormat = openai.F[openai.ChatCompletionNewParamsResponseFormatUnion](openai.ResponseFormatJSONSchemaParam{
+		Type: openai.F(openai.ResponseFormatJSONSchemaTypeJSONSchema),
+		JSONSchema: openai.F(openai.ResponseFormatJSONSchemaJSONSchemaParam{
+			Name:   openai.F("output"),
+			Schema: openai.F[interface{}](schema),
+			Strict: openai.F(false),
+		}),
+	})
+	res, err := s.sendQuery(ctx, baseURL, token, params)
 	if err != nil {
-		return "", s, err
+		return QueryResult{}, s, err
 	}
+	return s.processReply(ctx, res, nil)
+}
+
+// Add the model reply to the history, and handle its tool calls
+func (s OpenAIState) processReply(ctx context.Context, res *openai.ChatCompletion, tools []Tool) (QueryResult, LlmState, error) {
 	reply := res.Choices[0].Message
-	// Add the model reply to the history
-	s.history = append(s.history, reply)
-	// Handle tool calls
-	calls := res.Choices[0].Message.ToolCalls
-	for _, call := range calls {
-		result, err := s.callTool(ctx, call.Function.Name, call.Function.Arguments, tools)
-		if err != nil {
-			return "", s, err
+	result := QueryResult{
+		Reply: reply.Content,
+		Usage: openAIUsage(res),
+	}
+	message := Message{Role: "assistant"}
+	if reply.Content != "" || len(reply.ToolCalls) == 0 {
+		message.Content = textContent(reply.Content)
+	}
+	for _, call := range reply.ToolCalls {
+		message.ToolCalls = append(message.ToolCalls, ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	// Store the reply as a param: the encoding of ChatCompletionMessage
+	// drops the content of replies with tool calls.
+	s.history = append(s.history, openAIMessageParam(message))
+	outputs, err := callTools(ctx, message.ToolCalls, tools)
+	if err != nil {
+		return result, s, err
+	}
+	for i, call := range message.ToolCalls {
+		s.history = append(s.history, openai.ToolMessage(call.ID, outputs[i].Output))
+		if outputs[i].IsError {
+			s = s.withFailedCall(call.ID)
 		}
-		s.history = append(s.history, openai.ToolMessage(call.ID, result))
 	}
-	return reply.Content, s, nil
+	return result, s, nil
+}
+
+func openAIUsage(res *openai.ChatCompletion) TokenUsage {
+	return TokenUsage{
+		PromptTokens:     int(res.Usage.PromptTokens),
+		CompletionTokens: int(res.Usage.CompletionTokens),
+	}
 }
 
 func (s OpenAIState) sendQuery(
 	ctx context.Context,
-	model string,
-	endpoint *dagger.Service,
+	baseURL string,
 	token *dagger.Secret,
-	tools []Tool,
+	params openai.ChatCompletionNewParams,
+) (res *openai.ChatCompletion, rerr error) {
+	ctx, span := Tracer().Start(ctx, "[🤖] 💭")
+	defer func() {
+		if rerr != nil {
+			span.SetStatus(codes.Error, rerr.Error())
+		}
+		span.End()
+	}()
+	client, err := s.provider.client(ctx, baseURL, token)
+	if err != nil {
+		return nil, err
+	}
+	res, err = client.Chat.Completions.New(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	recordUsage(span, openAIUsage(res))
+	return res, nil
+}
+
+func (s OpenAIState) sendQueryStream(
+	ctx context.Context,
+	baseURL string,
+	token *dagger.Secret,
+	params openai.ChatCompletionNewParams,
+	onDelta func(string),
 ) (res *openai.ChatCompletion, rerr error) {
 	ctx, span := Tracer().Start(ctx, "[🤖] 💭")
 	defer func() {
@@ -114,6 +366,40 @@ func (s OpenAIState) sendQuery(
 		}
 		span.End()
 	}()
+	client, err := s.provider.client(ctx, baseURL, token)
+	if err != nil {
+		return nil, err
+	}
+	write, done := streamToSpan(ctx, onDelta)
+	defer done()
+	// Usage is sent in a last chunk, only on request
+	params.StreamOptions = openai.F(openai.ChatCompletionStreamOptionsParam{
+		IncludeUsage: openai.F(true),
+	})
+	stream := client.Chat.Completions.NewStreaming(ctx, params)
+	defer stream.Close()
+	// The accumulator reassembles content and tool call arguments from their chunks
+	var acc openai.ChatCompletionAccumulator
+	for stream.Next() {
+		chunk := stream.Current()
+		if !acc.AddChunk(chunk) {
+			return nil, fmt.Errorf("malformatted completion stream: unexpected chunk %s", chunk.ID)
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			write(chunk.Choices[0].Delta.Content)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	if len(acc.Choices) == 0 {
+		return nil, fmt.Errorf("empty completion stream")
+	}
+	recordUsage(span, openAIUsage(&acc.ChatCompletion))
+	return &acc.ChatCompletion, nil
+}
+
+func (s OpenAIState) params(model string, tools []Tool) openai.ChatCompletionNewParams {
 	var toolParams []openai.ChatCompletionToolParam
 	for _, tool := range tools {
 		toolParams = append(toolParams, openai.ChatCompletionToolParam{
@@ -125,96 +411,36 @@ func (s OpenAIState) sendQuery(
 			}),
 		})
 	}
-	opts := []option.RequestOption{option.WithHeader("Content-Type", "application/json")}
-	if token != nil {
-		key, err := token.Plaintext(ctx)
-		if err != nil {
-			return nil, err
-		}
-		opts = append(opts, option.WithAPIKey(key))
-	}
-	if endpoint != nil {
-		endpoint, err := endpoint.Start(ctx)
-		if err != nil {
-			return nil, err
-		}
-		url, err := endpoint.Endpoint(ctx, dagger.ServiceEndpointOpts{Scheme: "http"})
-		if err != nil {
-			return nil, err
-		}
-		opts = append(opts, option.WithBaseURL(url))
-	}
-	return openai.NewClient(opts...).Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+	params := openai.ChatCompletionNewParams{
 		Seed:     openai.Int(0),
 		Model:    openai.F(openai.ChatModel(model)),
 		Messages: openai.F(s.history),
-		Tools:    openai.F(toolParams),
-	})
-}
-
-func (s OpenAIState) callTool(ctx context.Context, name, input string, tools []Tool) (result string, rerr error) {
-	for _, tool := range tools {
-		if tool.Name() == name {
-			return tool.Call(ctx, input)
-		}
 	}
-	return "", fmt.Errorf("tool not available: %s", name)
+	// An empty tool list is rejected by the API
+	if len(toolParams) > 0 {
+		params.Tools = openai.F(toolParams)
+	}
+	return params
 }
 
 func (oai OpenAI) Load(data string) (LlmState, error) {
-	st := new(OpenAIState)
+	st := OpenAIState{provider: oai}
 	if data == "" {
 		return st, nil
 	}
-	var raw []openAIMessage
-	err := json.Unmarshal([]byte(data), &raw)
+	messages, err := decodeOpenAIMessages([]byte(data))
 	if err != nil {
 		return st, err
 	}
-	for _, msg := range raw {
-		switch msg.Role {
-		case "user":
-			text, err := msg.Text()
-			if err != nil {
-				return st, err
-			}
-			st.history = append(st.history, openai.UserMessage(text))
-		case "tool":
-			text, err := msg.Text()
-			if err != nil {
-				return st, err
-			}
-			st.history = append(st.history, openai.ToolMessage(msg.ToolCallID, text))
-		case "assistant":
-			text, err := msg.Text()
-			if err != nil {
-				return st, err
-			}
-			var calls []openai.ChatCompletionMessageToolCall
-			for _, call := range msg.ToolCalls {
-				calls = append(calls, openai.ChatCompletionMessageToolCall{
-					ID: call.ID,
-					Function: openai.ChatCompletionMessageToolCallFunction{
-						Arguments: call.Function.Arguments,
-						Name:      call.Function.Name,
-					},
-					Type: call.Type,
-				})
-			}
-			st.history = append(st.history, openai.ChatCompletionMessage{
-				Role:      "assistant",
-				Content:   text,
-				ToolCalls: calls,
-			})
-		}
-	}
-	return st, nil
+	return st.WithHistory(messages), nil
 }
 
+// A chat completion message, as encoded by the SDK
 type openAIMessage struct {
-	Role       string      `json:"role", required`
-	Content    interface{} `json:"content", required`
-	ToolCallID string      `json:"tool_call_id"`
+	Role string `json:"role"`
+	// Either a string, or a list of content parts
+	Content    json.RawMessage `json:"content"`
+	ToolCallID string          `json:"tool_call_id"`
 	ToolCalls  []struct {
 		// The ID of the tool call.
 		ID string `json:"id"`
@@ -229,34 +455,83 @@ type openAIMessage struct {
 	} `json:"tool_calls"`
 }
 
-func (msg openAIMessage) Text() (string, error) {
-	contentJson, err := json.Marshal(msg.Content)
-	if err != nil {
-		return "", err
+// Decode a JSON list of chat completion messages into provider-agnostic messages
+func decodeOpenAIMessages(data []byte) ([]Message, error) {
+	var raw []openAIMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
 	}
+	var messages []Message
+	for _, msg := range raw {
+		message, err := msg.message()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (msg openAIMessage) message() (Message, error) {
 	switch msg.Role {
-	case "user", "tool":
-		var content []struct {
-			Text string `json:"text", required`
+	case "system", "user", "tool", "assistant":
+	default:
+		return Message{}, fmt.Errorf("unsupported message role: %s", msg.Role)
+	}
+	message := Message{
+		Role:       msg.Role,
+		ToolCallID: msg.ToolCallID,
+	}
+	switch content := strings.TrimSpace(string(msg.Content)); {
+	case content == "" || content == "null":
+	case strings.HasPrefix(content, `"`):
+		var text string
+		if err := json.Unmarshal(msg.Content, &text); err != nil {
+			return message, fmt.Errorf("malformatted %s message: %w", msg.Role, err)
 		}
-		if err := json.Unmarshal(contentJson, &content); err != nil {
-			return "", fmt.Errorf("malformatted user or tool message: %s", err.Error())
+		message.Content = textContent(text)
+	default:
+		var parts []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			ImageURL struct {
+				URL string `json:"url"`
+			} `json:"image_url"`
 		}
-		if len(content) == 0 {
-			return "", nil
+		if err := json.Unmarshal(msg.Content, &parts); err != nil {
+			return message, fmt.Errorf("malformatted %s message: %w", msg.Role, err)
 		}
-		return content[0].Text, nil
-	case "assistant":
-		var content string
-		if err := json.Unmarshal(contentJson, &content); err != nil {
-			return "", fmt.Errorf("malformatted assistant message: %#v", content)
+		for _, part := range parts {
+			switch part.Type {
+			case "text":
+				message.Content = append(message.Content, ContentPart{Type: "text", Text: part.Text})
+			case "image_url":
+				image, err := openAIImagePart(part.ImageURL.URL)
+				if err != nil {
+					return message, fmt.Errorf("malformatted %s message: %w", msg.Role, err)
+				}
+				message.Content = append(message.Content, image)
+			default:
+				return message, fmt.Errorf("unsupported content part type in %s message: %s", msg.Role, part.Type)
+			}
 		}
-		return content, nil
 	}
-	return "", fmt.Errorf("unsupported message role: %s", msg.Role)
+	for _, call := range msg.ToolCalls {
+		message.ToolCalls = append(message.ToolCalls, ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return message, nil
 }
 
-func (s OpenAIState) Save() (string, error) {
-	data, err := json.Marshal(s.history)
-	return string(data), err
+// Convert a base64 data URL to an image content part
+func openAIImagePart(url string) (ContentPart, error) {
+	header, data, found := strings.Cut(url, ",")
+	mediaType, isBase64 := strings.CutSuffix(strings.TrimPrefix(header, "data:"), ";base64")
+	if !found || !strings.HasPrefix(header, "data:") || !isBase64 {
+		return ContentPart{}, fmt.Errorf("unsupported image URL: only base64 data URLs are supported")
+	}
+	return ContentPart{Type: "image", MediaType: mediaType, Data: data}, nil
 }
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Keywords checked by validateJSON
+var validationKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"anyOf": true, "oneOf": true, "allOf": true, "not": true,
+	"$ref": true, "$defs": true, "definitions": true,
+}
+
+// Keywords that don't constrain values, and are ignored by validateJSON
+var annotationKeywords = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true,
+	"title": true, "description": true, "default": true, "examples": true,
+	"format": true, "readOnly": true, "writeOnly": true, "deprecated": true,
+}
+
+// Check that validateJSON supports all the keywords of a schema,
+// so that values are never reported valid while breaking a constraint that isn't checked
+func checkSchema(schema map[string]interface{}) error {
+	return checkSubschema(schema, schema, "#")
+}
+
+func checkSubschema(root, schema map[string]interface{}, path string) error {
+	for _, key := range sortedKeys(schema) {
+		if !validationKeywords[key] && !annotationKeywords[key] {
+			return fmt.Errorf("%s: unsupported schema keyword %q", path, key)
+		}
+	}
+	check := func(value interface{}, path string) error {
+		sub, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a schema object", path)
+		}
+		return checkSubschema(root, sub, path)
+	}
+	for _, key := range []string{"properties", "$defs", "definitions"} {
+		if subs, ok := schema[key]; ok {
+			subs, ok := subs.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s/%s: expected an object", path, key)
+			}
+			for _, name := range sortedKeys(subs) {
+				if err := check(subs[name], path+"/"+key+"/"+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, key := range []string{"items", "not"} {
+		if sub, ok := schema[key]; ok {
+			if err := check(sub, path+"/"+key); err != nil {
+				return err
+			}
+		}
+	}
+	if additional, ok := schema["additionalProperties"]; ok {
+		if _, isBool := additional.(bool); !isBool {
+			if err := check(additional, path+"/additionalProperties"); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"anyOf", "oneOf", "allOf"} {
+		if subs, ok := schema[key]; ok {
+			subs, ok := subs.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s/%s: expected a list of schemas", path, key)
+			}
+			for i, sub := range subs {
+				if err := check(sub, fmt.Sprintf("%s/%s/%d", path, key, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if pattern, ok := schema["pattern"]; ok {
+		pattern, ok := pattern.(string)
+		if !ok {
+			return fmt.Errorf("%s/pattern: expected a string", path)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("%s/pattern: %w", path, err)
+		}
+	}
+	if ref, ok := schema["$ref"]; ok {
+		ref, ok := ref.(string)
+		if !ok {
+			return fmt.Errorf("%s/$ref: expected a string", path)
+		}
+		if _, err := resolveRef(root, ref); err != nil {
+			return fmt.Errorf("%s/$ref: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Resolve a reference to a part of the root schema, eg. "#/$defs/item"
+func resolveRef(root map[string]interface{}, ref string) (map[string]interface{}, error) {
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("unsupported reference %q: only references within the schema are supported", ref)
+	}
+	var current interface{} = root
+	if pointer != "" {
+		for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			switch node := current.(type) {
+			case map[string]interface{}:
+				current = node[token]
+			case []interface{}:
+				i, err := strconv.Atoi(token)
+				if err != nil || i < 0 || i >= len(node) {
+					return nil, fmt.Errorf("unresolved reference %q", ref)
+				}
+				current = node[i]
+			default:
+				current = nil
+			}
+		}
+	}
+	schema, ok := current.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolved reference %q", ref)
+	}
+	return schema, nil
+}
+
+// Validate a JSON document against a JSON schema.
+// Only the keywords listed in validationKeywords are checked: use checkSchema
+// to make sure a schema has no other constraints.
+func validateJSON(schema map[string]interface{}, data string) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	v := &schemaValidator{root: schema, following: map[string]bool{}}
+	return v.validateValue(schema, value, "$")
+}
+
+type schemaValidator struct {
+	// The root schema, to resolve references
+	root map[string]interface{}
+	// The references being followed, by reference and path, to detect cycles
+	following map[string]bool
+}
+
+func (v *schemaValidator) validateValue(schema map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := resolveRef(v.root, ref)
+		if err != nil {
+			return err
+		}
+		// A reference followed again without descending into the value never ends
+		key := ref + " " + path
+		if v.following[key] {
+			return fmt.Errorf("%s: circular reference %q", path, ref)
+		}
+		v.following[key] = true
+		err = v.validateValue(target, value, path)
+		delete(v.following, key)
+		if err != nil {
+			return err
+		}
+	}
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, t := range t {
+				if t, ok := t.(string); ok {
+					types = append(types, t)
+				}
+			}
+		}
+		var match bool
+		for _, t := range types {
+			if hasType(value, t) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), typeOf(value))
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		var match bool
+		for _, allowed := range enum {
+			if reflect.DeepEqual(value, allowed) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(value, c) {
+		return fmt.Errorf("%s: expected %v, got %v", path, c, value)
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && v.countMatches(anyOf, value, path) == 0 {
+		return fmt.Errorf("%s: matches none of the allowed schemas", path)
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok && v.countMatches(oneOf, value, path) != 1 {
+		return fmt.Errorf("%s: must match exactly one of the allowed schemas", path)
+	}
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			if sub, ok := sub.(map[string]interface{}); ok {
+				if err := v.validateValue(sub, value, path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok && v.validateValue(not, value, path) == nil {
+		return fmt.Errorf("%s: matches a forbidden schema", path)
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return v.validateObject(schema, value, path)
+	case []interface{}:
+		return v.validateArray(schema, value, path)
+	case string:
+		return validateString(schema, value, path)
+	case float64:
+		return validateNumber(schema, value, path)
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(schema map[string]interface{}, value map[string]interface{}, path string) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, ok := value[name]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	// Check properties in a stable order, so that errors are reproducible
+	for _, name := range sortedKeys(value) {
+		propPath := path + "." + name
+		if prop, ok := properties[name].(map[string]interface{}); ok {
+			if err := v.validateValue(prop, value[name], propPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := properties[name]; ok {
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unexpected property", propPath)
+			}
+		case map[string]interface{}:
+			if err := v.validateValue(additional, value[name], propPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateArray(schema map[string]interface{}, value []interface{}, path string) error {
+	if min, ok := schema["minItems"].(float64); ok && float64(len(value)) < min {
+		return fmt.Errorf("%s: expected at least %v items, got %d", path, min, len(value))
+	}
+	if max, ok := schema["maxItems"].(float64); ok && float64(len(value)) > max {
+		return fmt.Errorf("%s: expected at most %v items, got %d", path, max, len(value))
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range value {
+			for j := i + 1; j < len(value); j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					return fmt.Errorf("%s: items %d and %d are identical", path, i, j)
+				}
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range value {
+			if err := v.validateValue(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(schema map[string]interface{}, value string, path string) error {
+	length := utf8.RuneCountInString(value)
+	if min, ok := schema["minLength"].(float64); ok && float64(length) < min {
+		return fmt.Errorf("%s: expected at least %v characters, got %d", path, min, length)
+	}
+	if max, ok := schema["maxLength"].(float64); ok && float64(length) > max {
+		return fmt.Errorf("%s: expected at most %v characters, got %d", path, max, length)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern %q: %w", path, pattern, err)
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("%s: %q doesn't match the pattern %q", path, value, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(schema map[string]interface{}, value float64, path string) error {
+	// Draft 4 exclusiveMinimum and exclusiveMaximum are booleans, modifying minimum and maximum
+	exclusiveMin, _ := schema["exclusiveMinimum"].(bool)
+	exclusiveMax, _ := schema["exclusiveMaximum"].(bool)
+	if min, ok := schema["minimum"].(float64); ok {
+		if value < min || (exclusiveMin && value == min) {
+			return fmt.Errorf("%s: %v is less than the minimum %v", path, value, min)
+		}
+	}
+	if max, ok := schema["maximum"].(float64); ok {
+		if value > max || (exclusiveMax && value == max) {
+			return fmt.Errorf("%s: %v is more than the maximum %v", path, value, max)
+		}
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && value <= min {
+		return fmt.Errorf("%s: %v must be more than %v", path, value, min)
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && value >= max {
+		return fmt.Errorf("%s: %v must be less than %v", path, value, max)
+	}
+	if step, ok := schema["multipleOf"].(float64); ok && step > 0 {
+		if q := value / step; math.Abs(q-math.Round(q)) > 1e-9 {
+			return fmt.Errorf("%s: %v is not a multiple of %v", path, value, step)
+		}
+	}
+	return nil
+}
+
+// Count the schemas matched by a value
+func (v *schemaValidator) countMatches(schemas []interface{}, value interface{}, path string) int {
+	var n int
+	for _, schema := range schemas {
+		if schema, ok := schema.(map[string]interface{}); ok && v.validateValue(schema, value, path) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hasType(value interface{}, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	}
+	return typeOf(value) == t
+}
+
+// Return the JSON schema type of a decoded JSON value
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
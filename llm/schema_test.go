@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func mustSchema(t *testing.T, text string) map[string]interface{} {
+	t.Helper()
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &schema); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestValidateJSON(t *testing.T) {
+	schema := mustSchema(t, `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 2, "maxLength": 5, "pattern": "^[a-z]+$"},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"ratio": {"type": "number", "multipleOf": 0.5},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true},
+			"id": {"allOf": [{"type": "string"}, {"minLength": 3}]},
+			"kind": {"not": {"const": "forbidden"}},
+			"child": {"$ref": "#"}
+		},
+		"required": ["name"],
+		"additionalProperties": false,
+		"$defs": {"tag": {"type": "string", "enum": ["a", "b"]}}
+	}`)
+	if err := checkSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	for _, valid := range []string{
+		`{"name": "bob"}`,
+		`{"name": "bob", "age": 0, "ratio": 1.5, "tags": ["a", "b"], "id": "abc", "kind": "ok"}`,
+		`{"name": "bob", "child": {"name": "al", "child": {"name": "jo"}}}`,
+	} {
+		if err := validateJSON(schema, valid); err != nil {
+			t.Errorf("%s: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{
+		`{"name": "b"}`,
+		`{"name": "robert"}`,
+		`{"name": "Bob"}`,
+		`{"name": "bob", "age": -1}`,
+		`{"name": "bob", "age": 150}`,
+		`{"name": "bob", "ratio": 0.3}`,
+		`{"name": "bob", "tags": ["c"]}`,
+		`{"name": "bob", "tags": ["a", "a"]}`,
+		`{"name": "bob", "id": "ab"}`,
+		`{"name": "bob", "kind": "forbidden"}`,
+		`{"name": "bob", "child": {"name": "x"}}`,
+		`{"name": "bob", "other": 1}`,
+	} {
+		if err := validateJSON(schema, invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+// Each supported keyword rejects the values breaking its constraint
+func TestValidateJSONKeywords(t *testing.T) {
+	for _, test := range []struct {
+		keyword string
+		schema  string
+		valid   []string
+		invalid []string
+	}{
+		{"type", `{"type": "integer"}`, []string{`1`, `2.0`}, []string{`1.5`, `"1"`, `null`}},
+		{"type", `{"type": ["string", "null"]}`, []string{`"a"`, `null`}, []string{`1`, `false`}},
+		{"type", `{"type": "boolean"}`, []string{`true`}, []string{`0`, `{}`}},
+		{"enum", `{"enum": ["a", 1, null]}`, []string{`"a"`, `1`, `null`}, []string{`"b"`, `2`}},
+		{"const", `{"const": {"a": [1]}}`, []string{`{"a": [1]}`}, []string{`{"a": [2]}`, `{}`}},
+		{"properties", `{"properties": {"a": {"type": "string"}}}`, []string{`{}`, `{"a": "x", "b": 1}`, `1`}, []string{`{"a": 1}`}},
+		{"required", `{"required": ["a", "b"]}`, []string{`{"a": null, "b": 0}`}, []string{`{"a": 1}`, `{}`}},
+		{"additionalProperties", `{"properties": {"a": {}}, "additionalProperties": false}`, []string{`{"a": 1}`}, []string{`{"b": 1}`}},
+		{"additionalProperties", `{"additionalProperties": {"type": "number"}}`, []string{`{"a": 1}`}, []string{`{"a": "1"}`}},
+		{"items", `{"items": {"type": "string"}}`, []string{`[]`, `["a", "b"]`}, []string{`["a", 1]`}},
+		{"minItems", `{"minItems": 2}`, []string{`[1, 2]`}, []string{`[1]`}},
+		{"maxItems", `{"maxItems": 1}`, []string{`[]`, `[1]`}, []string{`[1, 2]`}},
+		{"uniqueItems", `{"uniqueItems": true}`, []string{`[1, "1", [1]]`}, []string{`[{"a": 1}, {"a": 1}]`}},
+		{"minLength", `{"minLength": 2}`, []string{`"éé"`}, []string{`"é"`}},
+		{"maxLength", `{"maxLength": 2}`, []string{`"éé"`}, []string{`"ééé"`}},
+		{"pattern", `{"pattern": "^a+$"}`, []string{`"aa"`, `1`}, []string{`"ab"`}},
+		{"minimum", `{"minimum": 1}`, []string{`1`, `2`}, []string{`0.5`}},
+		{"maximum", `{"maximum": 1}`, []string{`1`, `0`}, []string{`1.5`}},
+		{"exclusiveMinimum", `{"exclusiveMinimum": 1}`, []string{`1.5`}, []string{`1`}},
+		{"exclusiveMinimum", `{"minimum": 1, "exclusiveMinimum": true}`, []string{`2`}, []string{`1`}},
+		{"exclusiveMaximum", `{"exclusiveMaximum": 1}`, []string{`0.5`}, []string{`1`}},
+		{"exclusiveMaximum", `{"maximum": 1, "exclusiveMaximum": true}`, []string{`0`}, []string{`1`}},
+		{"multipleOf", `{"multipleOf": 0.1}`, []string{`0.3`, `2`}, []string{`0.25`}},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"minimum": 2}]}`, []string{`"a"`, `3`}, []string{`1`}},
+		{"oneOf", `{"oneOf": [{"type": "integer"}, {"minimum": 2}]}`, []string{`1`, `2.5`}, []string{`3`, `1.5`}},
+		{"allOf", `{"allOf": [{"type": "integer"}, {"minimum": 2}]}`, []string{`3`}, []string{`1`, `2.5`}},
+		{"not", `{"not": {"type": "string"}}`, []string{`1`}, []string{`"a"`}},
+		{"$ref", `{"$ref": "#/properties/a", "properties": {"a": {"type": "object"}}}`, []string{`{"a": {}}`}, []string{`[]`}},
+		{"$defs", `{"items": {"$ref": "#/$defs/item"}, "$defs": {"item": {"type": "string"}}}`, []string{`["a"]`}, []string{`[1]`}},
+		{"definitions", `{"items": {"$ref": "#/definitions/item"}, "definitions": {"item": {"type": "string"}}}`, []string{`["a"]`}, []string{`[1]`}},
+	} {
+		schema := mustSchema(t, test.schema)
+		if err := checkSchema(schema); err != nil {
+			t.Errorf("%s: %v", test.schema, err)
+			continue
+		}
+		for _, valid := range test.valid {
+			if err := validateJSON(schema, valid); err != nil {
+				t.Errorf("%s: %s: %v", test.schema, valid, err)
+			}
+		}
+		for _, invalid := range test.invalid {
+			if err := validateJSON(schema, invalid); err == nil {
+				t.Errorf("%s: %s: expected an error", test.schema, invalid)
+			}
+		}
+	}
+}
+
+// Annotations are accepted, and don't constrain values
+func TestValidateJSONAnnotations(t *testing.T) {
+	for keyword := range annotationKeywords {
+		schema := map[string]interface{}{keyword: "x"}
+		if err := checkSchema(schema); err != nil {
+			t.Errorf("%s: %v", keyword, err)
+		}
+		if err := validateJSON(schema, `{"a": 1}`); err != nil {
+			t.Errorf("%s: %v", keyword, err)
+		}
+	}
+}
+
+func TestCheckSchemaUnsupported(t *testing.T) {
+	for _, keyword := range []string{
+		"patternProperties", "propertyNames", "minProperties", "maxProperties",
+		"dependentRequired", "dependentSchemas", "dependencies", "unevaluatedProperties",
+		"prefixItems", "additionalItems", "contains", "minContains", "maxContains", "unevaluatedItems",
+		"if", "then", "else", "$dynamicRef", "$anchor", "contentMediaType",
+	} {
+		// Refused anywhere in the schema
+		schema := map[string]interface{}{"properties": map[string]interface{}{
+			"a": map[string]interface{}{keyword: map[string]interface{}{}},
+		}}
+		if err := checkSchema(schema); err == nil {
+			t.Errorf("%s: expected an error", keyword)
+		}
+	}
+
+	for _, text := range []string{
+		`{"type": "object", "patternProperties": {"^x": {"type": "string"}}}`,
+		`{"type": "object", "properties": {"a": {"if": {"type": "string"}, "then": {"minLength": 1}}}}`,
+		`{"type": "array", "prefixItems": [{"type": "string"}]}`,
+		`{"type": "array", "items": [{"type": "string"}]}`,
+		`{"anyOf": {"type": "string"}}`,
+		`{"properties": {"a": true}}`,
+		`{"not": {"$ref": "#/$defs/missing"}}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`{"type": "string", "pattern": "(?<=a)b"}`,
+	} {
+		if err := checkSchema(mustSchema(t, text)); err == nil {
+			t.Errorf("%s: expected an error", text)
+		}
+	}
+}
+
+func TestValidateJSONCircularReference(t *testing.T) {
+	schema := mustSchema(t, `{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`)
+	if err := validateJSON(schema, `1`); err == nil {
+		t.Fatal("expected an error")
+	}
+}
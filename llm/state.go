@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version of the serialized state format.
+// Bump it on incompatible changes to Message, and keep loading older versions.
+const stateVersion = 1
+
+// The serialized state of an Llm: its message history, independent of the provider.
+// Saving and loading it again yields the exact same history, whatever the provider.
+type savedState struct {
+	Version  int       `json:"version"`
+	Messages []Message `json:"messages"`
+}
+
+// Serialize the state of a provider session
+func saveState(st LlmState) (string, error) {
+	messages, err := st.History()
+	if err != nil {
+		return "", fmt.Errorf("save state: %w", err)
+	}
+	data, err := json.Marshal(savedState{
+		Version:  stateVersion,
+		Messages: messages,
+	})
+	return string(data), err
+}
+
+// Load a serialized state into a new provider session
+func loadState(provider LlmProvider, data string) (LlmState, error) {
+	if data == "" {
+		return provider.New(), nil
+	}
+	var saved savedState
+	if err := json.Unmarshal([]byte(data), &saved); err != nil || saved.Version == 0 {
+		// States saved before versioning are provider-specific
+		return provider.Load(data)
+	}
+	if saved.Version > stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d: this module supports up to version %d", saved.Version, stateVersion)
+	}
+	return provider.New().WithHistory(saved.Messages), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// A 1x1 PNG image
+const testPNG = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+// A history with every kind of message
+func sampleHistory() []Message {
+	return []Message{
+		{Role: "system", Content: textContent("You are a helpful assistant")},
+		{Role: "user", Content: []ContentPart{
+			{Type: "text", Text: "What's in this image? List the files too."},
+			{Type: "image", MediaType: "image/png", Data: testPNG},
+		}},
+		{Role: "assistant", Content: textContent("Let me look."), ToolCalls: []ToolCall{
+			{ID: "call_1", Name: "dagger", Arguments: `{"command":"host | directory . | entries"}`},
+			{ID: "call_2", Name: "read_manual", Arguments: `{"key":"shell"}`},
+		}},
+		{Role: "tool", ToolCallID: "call_1", Content: textContent(`{"output":"a.txt\nb.txt","success":true}`)},
+		{Role: "tool", ToolCallID: "call_2", Content: textContent("unknown manual: shell"), IsError: true},
+		{Role: "assistant", Content: textContent("A single pixel, and two files: a.txt and b.txt.")},
+		{Role: "user", Content: textContent("Thanks")},
+	}
+}
+
+// Saving a state, loading it and saving it again yields the same state, for each provider.
+// The golden files hold the state saved by each provider: run with -update to rewrite them.
+func TestStateRoundTrip(t *testing.T) {
+	for _, provider := range providers {
+		t.Run(provider.Name(), func(t *testing.T) {
+			golden := filepath.Join("testdata", "state", provider.Name()+".json")
+			if *update {
+				saved, err := saveState(provider.New().WithHistory(sampleHistory()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var indented bytes.Buffer
+				if err := json.Indent(&indented, []byte(saved), "", "  "); err != nil {
+					t.Fatal(err)
+				}
+				indented.WriteString("\n")
+				if err := os.WriteFile(golden, indented.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, data); err != nil {
+				t.Fatal(err)
+			}
+			want := compact.String()
+			saved := want
+			for i := 0; i < 2; i++ {
+				st, err := loadState(provider, saved)
+				if err != nil {
+					t.Fatal(err)
+				}
+				saved, err = saveState(st)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if saved != want {
+					t.Fatalf("round trip %d:\ngot  %s\nwant %s", i+1, saved, want)
+				}
+			}
+		})
+	}
+}
+
+// Each provider keeps the whole history, including what its API can't represent,
+// such as the errors of tool results
+func TestHistoryRoundTrip(t *testing.T) {
+	for _, provider := range providers {
+		t.Run(provider.Name(), func(t *testing.T) {
+			history, err := provider.New().WithHistory(sampleHistory()).History()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(history, sampleHistory()) {
+				t.Fatalf("got  %+v\nwant %+v", history, sampleHistory())
+			}
+		})
+	}
+}
+
+func TestSaveStateFailsOnLostMessages(t *testing.T) {
+	st := Anthropic{}.New().WithPrompt("hi").(AnthropicState)
+	st.Messages = append(st.Messages, anthropicMessage{
+		Role:    "assistant",
+		Content: []anthropicContentBlock{{Type: "unknown"}},
+	})
+	if _, err := saveState(st); err == nil {
+		t.Fatal("expected an error")
+	}
+	ollama := Ollama{}.New().WithPrompt("hi").(OllamaState)
+	ollama.Messages[0].Images = []string{"not base64"}
+	if _, err := saveState(ollama); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"dagger/sandbox/internal/dagger"
+	"fmt"
+	"strings"
+)
+
+// The changes between two states of a directory: added, modified and deleted files
+type ChangeSet struct {
+	// The directory before the changes
+	Before *dagger.Directory
+	// The directory after the changes
+	After *dagger.Directory
+}
+
+// A container with a git index holding the changes.
+// The git directory is kept out of the work tree, so that repositories in the directory are left alone.
+func (c ChangeSet) index() *dagger.Container {
+	return dag.Container().
+		From(alpineImage).
+		WithExec([]string{"apk", "add", "--no-cache", "git"}).
+		WithEnvVariable("GIT_DIR", "/changes.git").
+		WithEnvVariable("GIT_WORK_TREE", "/work").
+		WithDirectory("/work", c.Before).
+		WithExec([]string{"sh", "-c", "git init -q && git add -A && " +
+			"git -c user.name=sandbox -c user.email=sandbox@localhost commit -q --allow-empty -m before"}).
+		WithoutDirectory("/work").
+		WithDirectory("/work", c.After).
+		WithExec([]string{"git", "add", "-A"})
+}
+
+// Paths of the added files
+func (c ChangeSet) Added(ctx context.Context) ([]string, error) {
+	return c.paths(ctx, "A")
+}
+
+// Paths of the modified files
+func (c ChangeSet) Modified(ctx context.Context) ([]string, error) {
+	return c.paths(ctx, "M", "T")
+}
+
+// Paths of the deleted files
+func (c ChangeSet) Deleted(ctx context.Context) ([]string, error) {
+	return c.paths(ctx, "D")
+}
+
+// Return the paths with the given git status letters
+func (c ChangeSet) paths(ctx context.Context, statuses ...string) ([]string, error) {
+	out, err := c.index().
+		WithExec([]string{"git", "diff", "--cached", "--name-status", "--no-renames", "-z"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// With -z, statuses and paths are NUL-separated fields
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("malformatted git status: %q", out)
+	}
+	var paths []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		for _, status := range statuses {
+			if fields[i] == status {
+				paths = append(paths, fields[i+1])
+			}
+		}
+	}
+	return paths, nil
+}
+
+// The changes as a git-style patch: a unified diff, with binary files and deletions.
+// Apply it with "git apply", or with ChangeSet.Apply.
+func (c ChangeSet) Patch() *dagger.File {
+	return c.index().
+		WithExec([]string{"sh", "-c", "git diff --cached --binary --no-renames > /changes.patch"}).
+		File("/changes.patch")
+}
+
+// Apply the changes to another directory. Fails if the changes don't apply cleanly.
+func (c ChangeSet) Apply(dir *dagger.Directory) *dagger.Directory {
+	return dag.Container().
+		From(alpineImage).
+		WithExec([]string{"apk", "add", "--no-cache", "git"}).
+		WithDirectory("/work", dir).
+		WithWorkdir("/work").
+		WithFile("/changes.patch", c.Patch()).
+		WithExec([]string{"sh", "-c", "if [ -s /changes.patch ]; then git apply --whitespace=nowarn /changes.patch; fi"}).
+		Directory("/work")
+}
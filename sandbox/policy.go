@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Actions of the sandbox command policy
+const (
+	// Run the script
+	PolicyAllow = "allow"
+	// Don't run the script
+	PolicyDeny = "deny"
+	// Don't run the script without approval
+	PolicyApprove = "approve"
+)
+
+// What a policy rule matches
+const (
+	// Names of commands and functions, including module addresses
+	PolicyTargetCommand = "command"
+	// Hosts of URLs, module addresses and image references
+	PolicyTargetHost = "host"
+)
+
+// A rule of the sandbox command policy
+type PolicyRule struct {
+	// "allow", "deny" or "approve"
+	Action string
+	// "command" or "host"
+	Target string
+	// A pattern where "*" matches any text, eg. "publish", "github.com/acme/*", "*.internal"
+	Pattern string
+}
+
+// The decision of the policy for a script
+type PolicyDecision struct {
+	// "allow", "deny" or "approve"
+	Action string
+	// What the decision is about: a command, or a host
+	Subject string
+	// The rule that decided, or empty for the default action
+	Rule string
+	// Why the script was denied without checking the rules, eg. it can't be parsed
+	Reason string
+}
+
+func (d PolicyDecision) String() string {
+	if d.Reason != "" {
+		return fmt.Sprintf("%s %s (%s)", d.Action, d.Subject, d.Reason)
+	}
+	if d.Rule == "" {
+		return fmt.Sprintf("%s %s (default)", d.Action, d.Subject)
+	}
+	return fmt.Sprintf("%s %s (rule %q)", d.Action, d.Subject, d.Rule)
+}
+
+// Why the policy stopped a script, as an error
+type PolicyError struct {
+	Decision PolicyDecision
+}
+
+func (e *PolicyError) Error() string {
+	if e.Decision.Action == PolicyApprove {
+		return fmt.Sprintf("%s requires approval", e.Decision.Subject)
+	}
+	if e.Decision.Reason != "" {
+		return fmt.Sprintf("%s is denied by the sandbox policy: %s", e.Decision.Subject, e.Decision.Reason)
+	}
+	return fmt.Sprintf("%s is denied by the sandbox policy", e.Decision.Subject)
+}
+
+// Return the error as a tool result, shaped like run results, so that the model can react
+func (e *PolicyError) ToJSON() (string, error) {
+	res := struct {
+		Output  string `json:"output"`
+		Error   string `json:"error"`
+		Success bool   `json:"success"`
+		Status  string `json:"status"`
+	}{
+		Error:  e.Error(),
+		Status: "denied",
+	}
+	if e.Decision.Action == PolicyApprove {
+		res.Status = "approval_required"
+	}
+	b, err := json.Marshal(res)
+	return string(b), err
+}
+
+// Add a rule to the command policy. Rules are checked in order, the first match decides.
+// The decision for a script is the most restrictive of the decisions for its commands and hosts.
+func (s Sandbox) WithPolicyRule(
+	// "allow", "deny" or "approve"
+	action string,
+	// A pattern where "*" matches any text, eg. "publish", "github.com/acme/*", "*.internal"
+	pattern string,
+	// What the pattern matches: "command" for command and function names, including module addresses,
+	// or "host" for hosts of URLs, module addresses and image references
+	// +optional
+	// +default="command"
+	target string,
+) (Sandbox, error) {
+	if err := validatePolicyAction(action); err != nil {
+		return s, err
+	}
+	switch target {
+	case PolicyTargetCommand, PolicyTargetHost:
+	default:
+		return s, fmt.Errorf("unknown policy target: %q", target)
+	}
+	// Copy the list, so that sandboxes derived from each other don't share it
+	s.Policy = append(s.Policy[:len(s.Policy):len(s.Policy)], PolicyRule{
+		Action:  action,
+		Target:  target,
+		Pattern: pattern,
+	})
+	return s, nil
+}
+
+// Configure the action for commands matching no rule.
+// Set it to "deny" to allow only the commands matching an "allow" rule.
+// Hosts matching no rule are always allowed.
+func (s Sandbox) WithPolicyDefault(
+	// "allow", "deny" or "approve"
+	action string,
+) (Sandbox, error) {
+	if err := validatePolicyAction(action); err != nil {
+		return s, err
+	}
+	s.PolicyDefault = action
+	return s, nil
+}
+
+func validatePolicyAction(action string) error {
+	switch action {
+	case PolicyAllow, PolicyDeny, PolicyApprove:
+		return nil
+	}
+	return fmt.Errorf("unknown policy action: %q", action)
+}
+
+// Return true if a policy is configured
+func (s Sandbox) hasPolicy() bool {
+	return len(s.Policy) > 0 || (s.PolicyDefault != "" && s.PolicyDefault != PolicyAllow)
+}
+
+// Decide whether the policy lets a script run, without running it.
+// Without a policy, every script may run.
+func (s Sandbox) CheckPolicy(script string) PolicyDecision {
+	if !s.hasPolicy() {
+		return PolicyDecision{Action: PolicyAllow, Subject: "script"}
+	}
+	return s.checkPolicy(script)
+}
+
+// Decide whether a script may run
+func (s Sandbox) checkPolicy(script string) PolicyDecision {
+	defaultAction := s.PolicyDefault
+	if defaultAction == "" {
+		defaultAction = PolicyAllow
+	}
+	decision := PolicyDecision{Action: PolicyAllow, Subject: "script"}
+	decide := func(target, subject string) {
+		d := PolicyDecision{Action: PolicyAllow, Subject: subject}
+		// The default action is for commands: hosts are only restricted by their rules
+		if target == PolicyTargetCommand {
+			d.Action = defaultAction
+		}
+		for _, rule := range s.Policy {
+			if rule.Target == target && globMatch(rule.Pattern, subject) {
+				d.Action = rule.Action
+				d.Rule = rule.Pattern
+				break
+			}
+		}
+		if policySeverity(d.Action) > policySeverity(decision.Action) {
+			decision = d
+		}
+	}
+	commands, err := parseScript(script)
+	if err != nil {
+		// Commands that can't be found can't be checked
+		return PolicyDecision{Action: PolicyDeny, Subject: "script", Reason: err.Error()}
+	}
+	for _, command := range commands {
+		decide(PolicyTargetCommand, command[0])
+		for _, word := range command {
+			if host := hostOf(word); host != "" {
+				decide(PolicyTargetHost, host)
+			}
+		}
+	}
+	return decision
+}
+
+func policySeverity(action string) int {
+	switch action {
+	case PolicyDeny:
+		return 2
+	case PolicyApprove:
+		return 1
+	}
+	return 0
+}
+
+// Match a pattern where "*" matches any text, including "/"
+func globMatch(pattern, s string) bool {
+	re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	matched, err := regexp.MatchString(re, s)
+	return err == nil && matched
+}
+
+// Return the host of a URL, or of an address like "github.com/acme/repo" or "docker.io/library/alpine"
+func hostOf(word string) string {
+	if u, err := url.Parse(word); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Hostname()
+	}
+	first, _, found := strings.Cut(word, "/")
+	if !found || !strings.Contains(first, ".") || strings.HasPrefix(first, ".") {
+		return ""
+	}
+	// Strip a port
+	host, _, _ := strings.Cut(first, ":")
+	return host
+}
+
+// Split a dagger shell script into commands, each a list of words.
+// Commands are separated by pipes, newlines, ";", "&&" and "||".
+// Commands in substitutions, like "$(host | directory .)" or "`host`", are included too.
+// Quotes are removed. This is not a complete shell parser: it only needs
+// to find command names and arguments for the policy.
+// It fails if a substitution is not closed, since its commands can't be found.
+func parseScript(script string) ([][]string, error) {
+	var (
+		commands [][]string
+		command  []string
+		word     strings.Builder
+		inWord   bool
+	)
+	endWord := func() {
+		if inWord {
+			command = append(command, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(command) > 0 {
+			commands = append(commands, command)
+			command = nil
+		}
+	}
+	// Parse the substitution starting at the given index, and return the index of its end
+	substitute := func(runes []rune, i int) (int, error) {
+		var start, end int
+		if runes[i] == '`' {
+			start, end = i+1, closingBacktick(runes, i)
+			if end < 0 {
+				return 0, fmt.Errorf("unclosed %q", "`")
+			}
+		} else {
+			start, end = i+2, closingParen(runes, i+1)
+			if end < 0 {
+				return 0, fmt.Errorf("unclosed %q", "$(")
+			}
+		}
+		sub, err := parseScript(string(runes[start:end]))
+		if err != nil {
+			return 0, err
+		}
+		commands = append(commands, sub...)
+		return end, nil
+	}
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case r == '\'':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '\''; i++ {
+				word.WriteRune(runes[i])
+			}
+		case r == '"':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				} else if runes[i] == '`' || (runes[i] == '$' && i+1 < len(runes) && runes[i+1] == '(') {
+					end, err := substitute(runes, i)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(string(runes[i : end+1]))
+					i = end
+					continue
+				}
+				word.WriteRune(runes[i])
+			}
+		case r == '`' || (r == '$' && i+1 < len(runes) && runes[i+1] == '('):
+			end, err := substitute(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(string(runes[i : end+1]))
+			inWord = true
+			i = end
+		case r == '#' && !inWord:
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			endCommand()
+		case r == '|' || r == ';' || r == '&' || r == '\n' || r == '(' || r == ')':
+			endCommand()
+		case r == ' ' || r == '\t' || r == '\r':
+			endWord()
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	endCommand()
+	return commands, nil
+}
+
+// Return the index of the parenthesis closing the one at the given index,
+// or -1 if it is not closed
+func closingParen(runes []rune, open int) int {
+	depth := 0
+	var quote rune
+	for i := open; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' {
+				i++
+			}
+		case r == '\\':
+			i++
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Return the index of the backtick closing the one at the given index,
+// or -1 if it is not closed
+func closingBacktick(runes []rune, open int) int {
+	for i := open + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			i++
+		case '`':
+			return i
+		}
+	}
+	return -1
+}
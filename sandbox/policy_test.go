@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseScript(t *testing.T) {
+	got, err := parseScript(`github.com/acme/mod@v1 $(host | directory "." ) | build --tag 'a b' && publish ttl.sh/x # publish evil
+container | from docker.io/library/alpine; terminal
+echo "x $(git https://example.internal/repo | head)" ` + "`version`" + ` \
+  foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"host"}, {"directory", "."},
+		{"github.com/acme/mod@v1", `$(host | directory "." )`},
+		{"build", "--tag", "a b"},
+		{"publish", "ttl.sh/x"},
+		{"container"}, {"from", "docker.io/library/alpine"},
+		{"terminal"},
+		{"git", "https://example.internal/repo"}, {"head"},
+		{"version"},
+		{"echo", "x $(git https://example.internal/repo | head)", "`version`", "foo"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestParseScriptUnclosed(t *testing.T) {
+	for _, script := range []string{
+		"echo $(" + strings.Repeat("a", 25),
+		`echo "$(publish`,
+		"echo $(echo $(publish)",
+		"echo `publish",
+		"echo \"`publish\"",
+		"echo $(echo `publish)",
+	} {
+		if _, err := parseScript(script); err == nil {
+			t.Errorf("%q: expected an error", script)
+		}
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	s := Sandbox{}
+	if s.hasPolicy() {
+		t.Fatal("expected no policy")
+	}
+	s, _ = s.WithPolicyRule(PolicyDeny, "publish", PolicyTargetCommand)
+	s, _ = s.WithPolicyRule(PolicyApprove, "terminal", PolicyTargetCommand)
+	s, _ = s.WithPolicyRule(PolicyDeny, "*.internal", PolicyTargetHost)
+	if _, err := s.WithPolicyRule("maybe", "x", PolicyTargetCommand); err == nil {
+		t.Fatal("expected an error for an unknown action")
+	}
+	for script, want := range map[string]string{
+		"container | from alpine | with-exec ls | stdout": PolicyAllow,
+		"container | from alpine | publish ttl.sh/x":      PolicyDeny,
+		"container | terminal":                            PolicyApprove,
+		"container | terminal | publish x":                PolicyDeny,
+		"git https://repo.internal/x | head | tree":       PolicyDeny,
+		"echo $(publish)":                                 PolicyDeny,
+		"echo `publish`":                                  PolicyDeny,
+		"echo $(" + strings.Repeat("a", 25):               PolicyDeny,
+		"echo `container":                                 PolicyDeny,
+	} {
+		if got := s.checkPolicy(script); got.Action != want {
+			t.Errorf("%q: got %s", script, got)
+		}
+	}
+}
+
+func TestCheckPolicyUnclosed(t *testing.T) {
+	s, _ := Sandbox{}.WithPolicyRule(PolicyAllow, "*", PolicyTargetCommand)
+	decision := s.checkPolicy("container | from alpine | with-exec $(echo ls")
+	if decision.Action != PolicyDeny || decision.Reason == "" {
+		t.Fatalf("got %s", decision)
+	}
+	var err error = &PolicyError{Decision: decision}
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) || !strings.Contains(err.Error(), `unclosed "$("`) {
+		t.Fatalf("got %v", err)
+	}
+	out, err := policyErr.ToJSON()
+	if err != nil || !strings.Contains(out, `"status":"denied"`) {
+		t.Fatalf("got %s, %v", out, err)
+	}
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"context"
+	"dagger/sandbox/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+const alpineImage = "docker.io/library/alpine:latest@sha256:21dc6063fd678b478f57c0e13f47560d0ea4eeba26dfc947b2a4f81f686b9f45"
+
+const (
+	// Default wall-clock timeout of a run, in seconds
+	defaultRunTimeout = 600
+	// Default maximum size of the output of a run, in bytes, for each of stdout and stderr
+	defaultMaxRunOutput = 100000
+	// Exit code of timed out runs, like timeout(1)
+	timeoutExitCode = 124
+)
+
+func NewSandbox() Sandbox {
+	return Sandbox{
+		Home: dag.Directory(),
+		Base: dag.Container().From(alpineImage),
+		// FIXME: disable building dagger CLI from source, because of annoying cache misses in our CLI build
+		// DaggerCli: dag.DaggerCli().Binary(),
+		DaggerCli: dag.
+			Container().
+			From("registry.dagger.io/engine:main@sha256:50d03804e9c78dcded9f015816a7e7ffbb8b132c675647d64c69cfd19e1cc171").
+			File("/usr/local/bin/dagger"),
+		Username:  "👤",
+		Timeout:   defaultRunTimeout,
+		MaxOutput: defaultMaxRunOutput,
+	}
+}
+
+type Sandbox struct {
+	// The sandbox's home directory
+	Home *dagger.Directory
+	// Base image for the sandbox host computer
+	Base *dagger.Container
+	// User name (for traces and logs)
+	Username string
+	// Runs of script execution
+	Runs []Run
+	// Instruction manuals for the user of the sandbox
+	Manuals      []Manual
+	DaggerCli    *dagger.File // +private
+	History      []string
+	RemoteModule string            // +private
+	LocalModule  *dagger.Directory // +private
+	// Wall-clock timeout of a run, in seconds. Zero means no timeout.
+	Timeout int
+	// Maximum size of the output of a run, in bytes, for each of stdout and stderr.
+	// Zero means no limit.
+	MaxOutput int // +private
+	// The history, with timestamps and run details, for transcripts
+	Journal []JournalEntry // +private
+	// Rules of the command policy, checked before each run
+	Policy []PolicyRule // +private
+	// Action for commands matching no policy rule. Empty means "allow".
+	PolicyDefault string // +private
+	// The decision of the policy stopping the last script, or nil if it ran
+	Stopped *PolicyDecision // +private
+}
+
+// The host container for the sandbox
+func (s Sandbox) Host() *dagger.Container {
+	return s.Base.
+		WithMountedFile("/bin/dagger", s.DaggerCli).
+		WithEnvVariable("HOME", "/sandbox").
+		WithDirectory("$HOME", s.Home, dagger.ContainerWithDirectoryOpts{Expand: true}).
+		WithWorkdir("$HOME", dagger.ContainerWithWorkdirOpts{Expand: true}).
+		WithDefaultTerminalCmd([]string{"/bin/sh"}, dagger.ContainerWithDefaultTerminalCmdOpts{
+			ExperimentalPrivilegedNesting: true,
+		}).
+		WithFile("/bin/sandbox-entrypoint", s.sandboxEntrypoint()).
+		WithFile("/bin/sandbox-run", s.sandboxRun())
+}
+
+// A wrapper of the entrypoint enforcing the run timeout
+func (s Sandbox) sandboxRun() *dagger.File {
+	script := "#!/bin/sh\nexec /bin/sandbox-entrypoint\n"
+	if s.Timeout > 0 {
+		// Background commands read /dev/null: pass stdin through another descriptor.
+		// The watchdog doesn't hold the output open, so that it doesn't delay the end of the run.
+		script = fmt.Sprintf(`#!/bin/sh
+exec 3<&0
+/bin/sandbox-entrypoint <&3 &
+pid=$!
+( sleep %[1]d; touch /tmp/.sandbox-timed-out; kill -KILL $pid ) >/dev/null 2>&1 &
+watchdog=$!
+wait $pid
+code=$?
+kill $watchdog 2>/dev/null
+if [ -e /tmp/.sandbox-timed-out ]; then
+	rm -f /tmp/.sandbox-timed-out
+	echo "%[2]s" >&2
+	exit %[3]d
+fi
+exit $code
+`, s.Timeout, s.timeoutMessage(), timeoutExitCode)
+	}
+	return dag.Directory().
+		WithNewFile("sandbox-run", script, dagger.DirectoryWithNewFileOpts{Permissions: 0700}).
+		File("sandbox-run")
+}
+
+func (s Sandbox) timeoutMessage() string {
+	return fmt.Sprintf("sandbox: timed out after %ds", s.Timeout)
+}
+
+// Configure the wall-clock timeout of runs
+func (s Sandbox) WithTimeout(
+	// Timeout in seconds. Zero means no timeout.
+	seconds int,
+) Sandbox {
+	s.Timeout = seconds
+	return s
+}
+
+// Configure the maximum size of the output of runs.
+// Larger outputs keep their head and tail.
+func (s Sandbox) WithMaxOutput(
+	// Maximum size in bytes, for each of stdout and stderr. Zero means no limit.
+	size int,
+) Sandbox {
+	s.MaxOutput = size
+	return s
+}
+
+func (s Sandbox) sandboxEntrypoint() *dagger.File {
+	var script string
+	if s.LocalModule != nil {
+		script = "exec dagger shell -s -m /module"
+	} else if s.RemoteModule != "" {
+		// FIXME properly shell-escpape module name
+		script = fmt.Sprintf("exec dagger shell -s -m '%s'", s.RemoteModule)
+	} else {
+		script = "exec dagger shell -s"
+	}
+	return dag.Directory().
+		WithNewFile("sandbox-entrypoint", "#!/bin/sh\n"+script, dagger.DirectoryWithNewFileOpts{Permissions: 0700}).
+		File("sandbox-entrypoint")
+}
+
+// Configure a remote module as context for the sandbox
+func (s Sandbox) WithRemoteModule(address string) Sandbox {
+	s.LocalModule = nil
+	s.RemoteModule = address
+	return s
+}
+
+// Configure a local module as context for the sandbox
+func (s Sandbox) WithLocalModule(module *dagger.Directory) Sandbox {
+	s.RemoteModule = ""
+	s.LocalModule = module
+	return s
+}
+
+// All filesystem changes made to the host sandbox so far.
+// Deleted files are not included: use ChangeSet to track them.
+func (s Sandbox) Changes() *dagger.Directory {
+	changes := dag.Directory()
+	for _, run := range s.Runs {
+		changes = changes.WithDirectory("/", run.Changes())
+	}
+	return changes
+}
+
+// All changes made to the home directory by the runs so far, including deletions
+func (s Sandbox) ChangeSet() ChangeSet {
+	before := s.Home
+	if len(s.Runs) > 0 {
+		before = s.Runs[0].HostBefore.Directory("$HOME", dagger.ContainerDirectoryOpts{Expand: true})
+	}
+	return ChangeSet{
+		Before: before,
+		After:  s.Home,
+	}
+}
+
+func (s Sandbox) WithUsername(username string) Sandbox {
+	s.Username = username
+	return s
+}
+
+func (s Sandbox) WithSecret(name string, value *dagger.Secret) Sandbox {
+	s.Base = s.Base.WithSecretVariable(name, value)
+	return s
+}
+
+// Configure the sandbox's home directory
+func (s Sandbox) WithHome(home *dagger.Directory) Sandbox {
+	s.Home = home
+	return s
+}
+
+// Lookup a manual and return its contents.
+func (s Sandbox) ReadManual(ctx context.Context, key string) (string, error) {
+	manual, err := s.Manual(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return manual.Contents, nil
+}
+
+// Lookup a manual.
+// The read is traced, but not added to the history: callers keeping a history log the read with WithNote.
+func (s Sandbox) Manual(ctx context.Context, key string) (*Manual, error) {
+	for _, man := range s.Manuals {
+		if man.Name == key {
+			_, span := Tracer().Start(ctx, fmt.Sprintf("[%s] 📖 %s", s.Username, man.Description))
+			span.End()
+			return &man, nil
+		}
+	}
+	return nil, fmt.Errorf("no such manual: %s", key)
+}
+
+// Add a note to the sandbox history on behalf of the sandbox user
+func (s Sandbox) WithNote(ctx context.Context,
+	note string,
+	// The name of the user leaving the note. Default to the sandbox username
+	// +optional
+	username string,
+) Sandbox {
+	if username == "" {
+		username = s.Username
+	}
+	event := fmt.Sprintf("[%s] %s", username, note)
+	ctx, span := Tracer().Start(ctx, event)
+	span.End()
+	s.log(event, 0)
+	return s
+}
+
+// Add an entry to the history, and to the journal with a timestamp.
+// For runs, the journal refers to the run by its number in Runs: zero for other entries.
+func (s *Sandbox) log(entry string, run int) {
+	s.History = append(s.History, entry)
+	s.Journal = append(s.Journal, JournalEntry{
+		Time:  time.Now().UTC().Format(time.RFC3339Nano),
+		Entry: entry,
+		Run:   run,
+	})
+}
+
+// Add a run to the runs, and to the history
+func (s *Sandbox) logRun(run Run) {
+	s.Runs = append(s.Runs, run)
+	s.Stopped = nil
+	s.log(run.Short(), len(s.Runs))
+}
+
+// Log a run of a tool outside the sandbox, eg. a custom tool of an agent.
+// The tool doesn't change the sandbox: the host is the same before and after the run.
+// Its output is capped like the output of scripts.
+func (s Sandbox) WithToolRun(
+	// The name of the tool
+	tool string,
+	// The input of the tool
+	input string,
+	stdout string,
+	stderr string,
+	exitCode int,
+	// When the run started, in RFC 3339 format
+	started string,
+	// How long the run took, in milliseconds
+	duration int,
+	// The run was interrupted by the sandbox timeout. Its exit code is then the one of timed out scripts.
+	// +optional
+	timedOut bool,
+) Sandbox {
+	if timedOut {
+		exitCode = timeoutExitCode
+	}
+	host := s.Host()
+	s.logRun(Run{
+		Username:   s.Username,
+		Tool:       tool,
+		Script:     input,
+		HostBefore: host,
+		HostAfter:  host,
+		Stdout:     s.capOutput(stdout),
+		Stderr:     s.capOutput(stderr),
+		ExitCode:   exitCode,
+		TimedOut:   timedOut,
+		Started:    started,
+		Duration:   duration,
+	})
+	return s
+}
+
+func (s Sandbox) WithManual(
+	// Unique key for the manual
+	key,
+	// Description for the knowledge. Keep it short, like the cover of a book.
+	description,
+	// Contents of the manual
+	contents string,
+) Sandbox {
+	s.Manuals = append(s.Manuals, Manual{
+		Name:        key,
+		Description: description,
+		Contents:    contents,
+	})
+	return s
+}
+
+// Import manuals from a directory into the sandbox
+// Any .txt or .md file will be read.
+// - The filename (minus the extension) is the key
+// - The first paragraph is the description
+// - The rest of the file is the contents
+func (s Sandbox) ImportManuals(ctx context.Context, dir *dagger.Directory) (Sandbox, error) {
+	txtPaths, err := dir.Glob(ctx, "**/*.txt")
+	if err != nil {
+		return s, err
+	}
+	mdPaths, err := dir.Glob(ctx, "**/*.md")
+	if err != nil {
+		return s, err
+	}
+	paths := append(txtPaths, mdPaths...)
+	toolnameRE := regexp.MustCompile("[^a-zA-Z0-9_-]")
+	for _, p := range paths {
+		doc, err := dir.File(p).Contents(ctx)
+		if err != nil {
+			return s, err
+		}
+		// Use regex to split paragraphs, allowing for any amount of whitespace or newlines
+		re := regexp.MustCompile(`(?m)^\s*$`)
+		parts := re.Split(doc, 2)
+		description := strings.TrimSpace(parts[0])
+		contents := ""
+		if len(parts) > 1 {
+			contents = strings.TrimSpace(parts[1])
+		}
+		// Scrub filename
+		p = p[:len(p)-len(filepath.Ext(p))]
+		key := toolnameRE.ReplaceAllString(p, "")
+		s = s.WithManual(key, description, contents)
+	}
+	return s, nil
+}
+
+// An instruction manual for the user of the sandbox
+type Manual struct {
+	Name        string
+	Description string
+	Contents    string
+}
+
+// The result of the last script or tool run as JSON, eg. to report it to a model as a tool result.
+// Scripts stopped by the policy report why, rather than failing.
+func (s Sandbox) Result() (string, error) {
+	if s.Stopped != nil {
+		return (&PolicyError{Decision: *s.Stopped}).ToJSON()
+	}
+	run, err := s.LastRun()
+	if err != nil {
+		return "", err
+	}
+	return run.ToJSON()
+}
+
+func (s Sandbox) LastRun() (*Run, error) {
+	if len(s.Runs) == 0 {
+		return nil, fmt.Errorf("no run in the history")
+	}
+	return &s.Runs[len(s.Runs)-1], nil
+}
+
+// A state of the sandbox that can be restored: the state before a run
+type Checkpoint struct {
+	// Number of the run, starting at 1. Rewind to it to restore this checkpoint.
+	Run int
+	// The run that followed the checkpoint
+	Description string
+	// The sandbox's home directory at the checkpoint
+	Home *dagger.Directory
+}
+
+// List the checkpoints of the sandbox: one before each run
+func (s Sandbox) Checkpoints() []Checkpoint {
+	var checkpoints []Checkpoint
+	for i, run := range s.Runs {
+		checkpoints = append(checkpoints, Checkpoint{
+			Run:         i + 1,
+			Description: run.Short(),
+			Home:        run.HostBefore.Directory("$HOME", dagger.ContainerDirectoryOpts{Expand: true}),
+		})
+	}
+	return checkpoints
+}
+
+// Restore the sandbox to its state before the given run, and forget that run and the following ones.
+// The history keeps them, with a note of the rewind.
+func (s Sandbox) Rewind(
+	ctx context.Context,
+	// Number of the run to restore the state before, starting at 1
+	run int,
+) (Sandbox, error) {
+	if run < 1 || run > len(s.Runs) {
+		return s, fmt.Errorf("no run %d: the sandbox has %d runs", run, len(s.Runs))
+	}
+	host := s.Runs[run-1].HostBefore
+	s.Base = host.WithoutDirectory("$HOME", dagger.ContainerWithoutDirectoryOpts{Expand: true})
+	s.Home = host.Directory("$HOME", dagger.ContainerDirectoryOpts{Expand: true})
+	// The journal keeps the forgotten runs, for transcripts.
+	// Copy the lists, so that forks don't share them.
+	s.Journal = append([]JournalEntry(nil), s.Journal...)
+	for i, entry := range s.Journal {
+		if entry.Run >= run {
+			rewound := s.Runs[entry.Run-1]
+			s.Journal[i].Run = 0
+			s.Journal[i].RewoundRun = &rewound
+		}
+	}
+	s.Runs = append([]Run(nil), s.Runs[:run-1]...)
+	return s.WithNote(ctx, fmt.Sprintf("⏪ rewound to before run %d", run), ""), nil
+}
+
+// Start an independent copy of the sandbox, to explore an alternative from the current state.
+// Combine with Rewind to explore from an earlier checkpoint.
+func (s Sandbox) Fork(
+	ctx context.Context,
+	// A name for the fork, shown in the history
+	// +optional
+	name string,
+) Sandbox {
+	s.Runs = append([]Run(nil), s.Runs...)
+	s.Manuals = append([]Manual(nil), s.Manuals...)
+	s.History = append([]string(nil), s.History...)
+	s.Journal = append([]JournalEntry(nil), s.Journal...)
+	note := "🍴 forked"
+	if name != "" {
+		note += " " + name
+	}
+	return s.WithNote(ctx, note, "")
+}
+
+// Open an interactive terminal session
+func (s Sandbox) Terminal(ctx context.Context) (Sandbox, error) {
+	_, err := s.Host().Terminal(dagger.ContainerTerminalOpts{
+		Cmd:                           []string{"/bin/sandbox-entrypoint"},
+		ExperimentalPrivilegedNesting: true,
+	}).Sync(ctx)
+	return s, err
+}
+
+// Run a script in the sandbox.
+// Scripts stopped by the policy don't run: the history and Result tell why.
+func (s Sandbox) Run(
+	ctx context.Context,
+	script string,
+	// The user approved the script, so that the policy lets it run even if it requires approval
+	// +optional
+	approved bool,
+) (rs Sandbox, rerr error) {
+	ctx, span := Tracer().Start(ctx, fmt.Sprintf("[%s] 💻 %s\n", s.Username, script))
+	defer func() {
+		if rerr != nil {
+			span.SetStatus(codes.Error, rerr.Error())
+		}
+		span.End()
+	}()
+	// Check the script against the policy before anything runs, and log the decision
+	if s.hasPolicy() {
+		decision := s.checkPolicy(script)
+		if decision.Action == PolicyApprove && approved {
+			s = s.WithNote(ctx, "🛡️ "+decision.String()+", approved", "")
+		} else {
+			s = s.WithNote(ctx, "🛡️ "+decision.String(), "")
+		}
+		if decision.Action == PolicyDeny || (decision.Action == PolicyApprove && !approved) {
+			s.Stopped = &decision
+			return s, nil
+		}
+	}
+	started := time.Now()
+	hostBefore := s.Host()
+	hostAfter := hostBefore.
+		WithExec(
+			[]string{"/bin/sandbox-run"},
+			dagger.ContainerWithExecOpts{
+				ExperimentalPrivilegedNesting: true,
+				Expect:                        dagger.ReturnTypeAny,
+				Stdin:                         script,
+			},
+		)
+	stdout, err := hostAfter.Stdout(ctx)
+	if err != nil {
+		return s, err
+	}
+	stderr, err := hostAfter.Stderr(ctx)
+	if err != nil {
+		return s, err
+	}
+	exitCode, err := hostAfter.ExitCode(ctx)
+	if err != nil {
+		return s, err
+	}
+	if exitCode != 0 {
+		span.SetStatus(codes.Error, stderr)
+	}
+	timedOut := s.Timeout > 0 && exitCode == timeoutExitCode &&
+		strings.HasSuffix(strings.TrimSpace(stderr), s.timeoutMessage())
+	run := Run{
+		Username:   s.Username,
+		HostBefore: hostBefore,
+		Script:     script,
+		Stdout:     s.capOutput(stdout),
+		Stderr:     s.capOutput(stderr),
+		ExitCode:   exitCode,
+		TimedOut:   timedOut,
+		HostAfter:  hostAfter,
+		Started:    started.UTC().Format(time.RFC3339Nano),
+		Duration:   int(time.Since(started).Milliseconds()),
+	}
+	s.logRun(run)
+	s.Base = hostAfter.WithoutDirectory("$HOME", dagger.ContainerWithoutDirectoryOpts{Expand: true})
+	s.Home = hostAfter.Directory("$HOME", dagger.ContainerDirectoryOpts{Expand: true})
+	return s, nil
+}
+
+type Run struct {
+	Username string
+	// For runs of tools outside the sandbox: the name of the tool.
+	// The script is then the input of the tool.
+	Tool       string
+	Script     string
+	HostBefore *dagger.Container
+	HostAfter  *dagger.Container
+	Stdout     string
+	Stderr     string
+	ExitCode   int
+	// The run was killed after the sandbox timeout
+	TimedOut bool
+	// When the run started, in RFC 3339 format
+	Started string
+	// How long the run took, in milliseconds
+	Duration int
+}
+
+func (r Run) Short() string {
+	var emoji string
+	switch {
+	case r.TimedOut:
+		emoji = "⏱️"
+	case r.ExitCode == 0:
+		emoji = "✅"
+	default:
+		emoji = "☠️"
+	}
+	if r.Tool != "" {
+		return fmt.Sprintf("[%s] 🔧%s %s", r.Username, emoji, r.command())
+	}
+	return fmt.Sprintf("[%s] 💻%s %s", r.Username, emoji, r.command())
+}
+
+// The command line of the run: the script, or the tool and its input
+func (r Run) command() string {
+	if r.Tool != "" {
+		return r.Tool + " " + r.Script
+	}
+	return r.Script
+}
+
+// All filesystem changes made by the run
+func (r Run) Changes() *dagger.Directory {
+	return r.HostBefore.Rootfs().Diff(r.HostAfter.Rootfs())
+}
+
+func (r Run) ToJSON() (string, error) {
+	var res struct {
+		Output  string `json:"output"`
+		Error   string `json:"error"`
+		Success bool   `json:"success"`
+		// "success", "failure" or "timed_out"
+		Status string `json:"status"`
+	}
+	// Remove all ANSI escape codes (eg. part of raw interactive shell output), to avoid json marshalling failing
+	re := regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+	res.Output = re.ReplaceAllString(r.Stdout, "")
+	res.Error = re.ReplaceAllString(r.Stderr, "")
+	res.Success = (r.ExitCode == 0)
+	switch {
+	case r.TimedOut:
+		res.Status = "timed_out"
+	case res.Success:
+		res.Status = "success"
+	default:
+		res.Status = "failure"
+	}
+	b, err := json.Marshal(res)
+	return string(b), err
+}
+
+// Cap the output of a run to the maximum size
+func (s Sandbox) capOutput(output string) string {
+	if s.MaxOutput <= 0 {
+		return output
+	}
+	return elide(output, s.MaxOutput)
+}
+
+// Shorten a text to at most max bytes, keeping its head and tail
+func elide(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	// Leave room for the marker, so that elided text is never elided again.
+	// The marker is longest when the whole text is elided.
+	room := len(elisionMarker(len(text)))
+	if max < room {
+		// No room for a marker: keep the head
+		end := max
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		return text[:end]
+	}
+	keep := max - room
+	head := keep / 2
+	for head > 0 && !utf8.RuneStart(text[head]) {
+		head--
+	}
+	tail := len(text) - (keep - head)
+	for tail < len(text) && !utf8.RuneStart(text[tail]) {
+		tail++
+	}
+	return text[:head] + elisionMarker(tail-head) + text[tail:]
+}
+
+func elisionMarker(elided int) string {
+	return fmt.Sprintf("\n[... %d bytes elided ...]\n", elided)
+}
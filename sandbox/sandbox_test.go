@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestElide(t *testing.T) {
+	for _, text := range []string{
+		strings.Repeat("x", 1000),
+		strings.Repeat("é", 500),
+		strings.Repeat("日本語", 100),
+	} {
+		room := len(elisionMarker(len(text)))
+		for _, max := range []int{0, 1, 2, room - 1, room, room + 1, room + 2, 100, len(text) - 1, len(text), len(text) + 1} {
+			elided := elide(text, max)
+			if len(elided) > max && len(text) > max {
+				t.Errorf("%d bytes, max %d: got %d bytes", len(text), max, len(elided))
+			}
+			if !utf8.ValidString(elided) {
+				t.Errorf("%d bytes, max %d: split a character: %q", len(text), max, elided)
+			}
+			if max >= len(text) && elided != text {
+				t.Errorf("%d bytes, max %d: expected the text unchanged", len(text), max)
+			}
+			if max >= room && max < len(text) && !strings.Contains(elided, "bytes elided") {
+				t.Errorf("%d bytes, max %d: expected a marker, got %q", len(text), max, elided)
+			}
+			// Elided text is never elided again
+			if again := elide(elided, max); again != elided {
+				t.Errorf("%d bytes, max %d: elided again to %q", len(text), max, again)
+			}
+		}
+	}
+}
+
+// Results report the last run, or why the policy stopped the last script
+func TestResult(t *testing.T) {
+	s := Sandbox{Username: "agent"}
+	if _, err := s.Result(); err == nil {
+		t.Fatal("expected an error without runs")
+	}
+	s.Stopped = &PolicyDecision{Action: PolicyApprove, Subject: "terminal", Rule: "terminal"}
+	out, err := s.Result()
+	if err != nil || !strings.Contains(out, `"status":"approval_required"`) {
+		t.Fatalf("got %s, %v", out, err)
+	}
+	s.logRun(Run{Username: "agent", Script: "version", Stdout: "v0.15.2\x1b[0m", ExitCode: 0})
+	if s.Stopped != nil {
+		t.Fatal("expected the run to clear the policy stop")
+	}
+	out, err = s.Result()
+	if err != nil || out != `{"output":"v0.15.2","error":"","success":true,"status":"success"}` {
+		t.Fatalf("got %s, %v", out, err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"dagger/sandbox/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An entry of the sandbox history, with the details needed to replay it
+type JournalEntry struct {
+	// When the entry was logged, in RFC 3339 format
+	Time string
+	// The history entry
+	Entry string
+	// For runs: the number of the run in Runs, starting at 1
+	Run int
+	// For runs forgotten by a rewind: the run, which is no longer in Runs
+	RewoundRun *Run
+}
+
+// Return the run of a journal entry, or nil if the entry is not a run
+func (s Sandbox) journalRun(entry JournalEntry) *Run {
+	switch {
+	case entry.RewoundRun != nil:
+		return entry.RewoundRun
+	case entry.Run > 0 && entry.Run <= len(s.Runs):
+		return &s.Runs[entry.Run-1]
+	}
+	return nil
+}
+
+// Split a history entry into the user name and the text
+func splitEntry(entry string) (user, text string) {
+	if strings.HasPrefix(entry, "[") {
+		if i := strings.Index(entry, "] "); i > 0 {
+			return entry[1:i], entry[i+2:]
+		}
+	}
+	return "", entry
+}
+
+// Export the session as a transcript: every prompt, reply, note and run, with timestamps.
+// Runs include their script, output and exit code.
+func (s Sandbox) Transcript(
+	// "markdown", or "jsonl" for one JSON object per entry
+	// +optional
+	// +default="markdown"
+	format string,
+) (*dagger.File, error) {
+	var (
+		name     string
+		contents string
+		err      error
+	)
+	switch format {
+	case "markdown":
+		name, contents = "transcript.md", s.markdownTranscript()
+	case "jsonl":
+		name = "transcript.jsonl"
+		contents, err = s.jsonlTranscript()
+	default:
+		return nil, fmt.Errorf("unknown transcript format: %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dag.Directory().WithNewFile(name, contents).File(name), nil
+}
+
+func (s Sandbox) markdownTranscript() string {
+	var out strings.Builder
+	out.WriteString("# Sandbox transcript\n")
+	for _, entry := range s.Journal {
+		user, text := splitEntry(entry.Entry)
+		fmt.Fprintf(&out, "\n---\n\n**%s** · `%s`\n\n", user, entry.Time)
+		run := s.journalRun(entry)
+		if run == nil {
+			out.WriteString(text + "\n")
+			continue
+		}
+		// Tool runs show the tool, and their JSON input as script
+		label, lang := "💻", "sh"
+		if run.Tool != "" {
+			label, lang = "🔧 "+run.Tool, "json"
+		}
+		switch {
+		case run.TimedOut:
+			fmt.Fprintf(&out, "%s⏱️ Timed out after %s\n", label, time.Duration(run.Duration)*time.Millisecond)
+		default:
+			fmt.Fprintf(&out, "%s Exit code %d, in %s\n", label, run.ExitCode, time.Duration(run.Duration)*time.Millisecond)
+		}
+		out.WriteString("\n" + codeBlock(lang, run.Script))
+		if run.Stdout != "" {
+			out.WriteString("\nStdout:\n\n" + codeBlock("", run.Stdout))
+		}
+		if run.Stderr != "" {
+			out.WriteString("\nStderr:\n\n" + codeBlock("", run.Stderr))
+		}
+	}
+	return out.String()
+}
+
+// Return a fenced code block, with a fence longer than any backtick run in the code
+func codeBlock(lang, code string) string {
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + strings.TrimSuffix(code, "\n") + "\n" + fence + "\n"
+}
+
+type transcriptEntry struct {
+	Time string         `json:"time"`
+	User string         `json:"user"`
+	Text string         `json:"text"`
+	Run  *transcriptRun `json:"run,omitempty"`
+}
+
+type transcriptRun struct {
+	Tool       string `json:"tool,omitempty"`
+	Script     string `json:"script"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ExitCode   int    `json:"exit_code"`
+	TimedOut   bool   `json:"timed_out"`
+	Started    string `json:"started"`
+	DurationMs int    `json:"duration_ms"`
+}
+
+func (s Sandbox) jsonlTranscript() (string, error) {
+	var out strings.Builder
+	enc := json.NewEncoder(&out)
+	for _, entry := range s.Journal {
+		user, text := splitEntry(entry.Entry)
+		e := transcriptEntry{Time: entry.Time, User: user, Text: text}
+		if run := s.journalRun(entry); run != nil {
+			e.Run = &transcriptRun{
+				Tool:       run.Tool,
+				Script:     run.Script,
+				Stdout:     run.Stdout,
+				Stderr:     run.Stderr,
+				ExitCode:   run.ExitCode,
+				TimedOut:   run.TimedOut,
+				Started:    run.Started,
+				DurationMs: run.Duration,
+			}
+		}
+		if err := enc.Encode(e); err != nil {
+			return "", err
+		}
+	}
+	return out.String(), nil
+}
+
+// Export the session as an asciicast v2 recording, to play back with asciinema,
+// or to load with the termcast module's DecodeFile.
+// Runs are shown as commands typed at a prompt, followed by their output.
+func (s Sandbox) Asciicast(
+	// The width of the terminal
+	// +optional
+	// +default=120
+	width int,
+	// The height of the terminal
+	// +optional
+	// +default=40
+	height int,
+) (*dagger.File, error) {
+	contents, err := s.asciicast(width, height)
+	if err != nil {
+		return nil, err
+	}
+	return dag.Directory().WithNewFile("session.cast", contents).File("session.cast"), nil
+}
+
+func (s Sandbox) asciicast(width, height int) (string, error) {
+	type event struct {
+		time time.Time
+		data string
+	}
+	var events []event
+	for _, entry := range s.Journal {
+		at, err := time.Parse(time.RFC3339Nano, entry.Time)
+		if err != nil {
+			return "", fmt.Errorf("journal entry %q: %w", entry.Entry, err)
+		}
+		run := s.journalRun(entry)
+		if run == nil {
+			user, text := splitEntry(entry.Entry)
+			events = append(events, event{at, fmt.Sprintf("\x1b[2m[%s]\x1b[0m %s\n", user, text)})
+			continue
+		}
+		started, err := time.Parse(time.RFC3339Nano, run.Started)
+		if err != nil {
+			return "", fmt.Errorf("run %q: %w", run.Script, err)
+		}
+		output := run.Stdout + run.Stderr
+		if output != "" && !strings.HasSuffix(output, "\n") {
+			output += "\n"
+		}
+		switch {
+		case run.TimedOut:
+			output += "\x1b[31mtimed out\x1b[0m\n"
+		case run.ExitCode != 0:
+			output += fmt.Sprintf("\x1b[31mexit code %d\x1b[0m\n", run.ExitCode)
+		}
+		events = append(events,
+			event{started, fmt.Sprintf("\x1b[1m%s $\x1b[0m %s\n", run.Username, run.command())},
+			event{started.Add(time.Duration(run.Duration) * time.Millisecond), output},
+		)
+	}
+	// Runs start before they are logged: keep events in time order
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time.Before(events[j].time)
+	})
+	var out strings.Builder
+	header := map[string]interface{}{
+		"version": 2,
+		"width":   width,
+		"height":  height,
+	}
+	if len(events) > 0 {
+		header["timestamp"] = events[0].time.Unix()
+	}
+	enc := json.NewEncoder(&out)
+	if err := enc.Encode(header); err != nil {
+		return "", err
+	}
+	for _, e := range events {
+		if e.data == "" {
+			continue
+		}
+		// Terminals need carriage returns
+		data := strings.ReplaceAll(strings.ReplaceAll(e.data, "\r\n", "\n"), "\n", "\r\n")
+		seconds := e.time.Sub(events[0].time).Seconds()
+		if err := enc.Encode([3]interface{}{seconds, "o", data}); err != nil {
+			return "", err
+		}
+	}
+	return out.String(), nil
+}
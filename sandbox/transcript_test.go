@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestJournalRuns(t *testing.T) {
+	s := Sandbox{Username: "agent"}
+	s = s.WithNote(context.Background(), "hello", "user")
+	s.logRun(Run{Username: "agent", Script: "container | from alpine", Stdout: "first", Started: "2025-01-01T00:00:00Z"})
+	s.logRun(Run{Username: "agent", Tool: "lint", Script: `{"path":"."}`, Stderr: "500 Internal Server Error", ExitCode: 1, Started: "2025-01-01T00:00:01Z"})
+	for i, want := range []int{0, 1, 2} {
+		if s.Journal[i].Run != want {
+			t.Fatalf("entry %d: got run %d, want %d", i, s.Journal[i].Run, want)
+		}
+	}
+	if run := s.journalRun(s.Journal[2]); run == nil || run.Tool != "lint" {
+		t.Fatalf("got %+v", run)
+	}
+	if s.History[2] != `[agent] 🔧☠️ lint {"path":"."}` {
+		t.Fatalf("got %q", s.History[2])
+	}
+	// Runs forgotten by a rewind stay in the journal
+	rewound := s.Runs[0]
+	s.Journal[1].Run, s.Journal[1].RewoundRun = 0, &rewound
+	s.Runs = s.Runs[1:]
+	s.Journal[2].Run = 1
+	md := s.markdownTranscript()
+	for _, want := range []string{"first", "🔧 lint Exit code 1", "500 Internal Server Error"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("expected %q in the transcript:\n%s", want, md)
+		}
+	}
+}